@@ -0,0 +1,190 @@
+package external
+
+/* Validate shipping addresses before they are priced or sent to Printify */
+
+import (
+	"fmt"
+	"regexp"
+	"server/config"
+	"server/error_messages"
+	"strings"
+)
+
+// Longest value Printify accepts for an address field
+const maxAddressField = 100
+
+// A field of the address the customer has to fix, named by its JSON path in
+// ClientInfo, ex: address.postal_code
+type AddressError struct {
+	Field string `json:"field"`
+	Error string `json:"error"`
+}
+
+// What a country's addresses need besides a street, city and country
+type countryFormat struct {
+	// Postal codes must match, they are optional for countries without a format
+	PostalCode *regexp.Regexp
+	// Valid state codes, the state is optional for countries without any
+	States []string
+}
+
+var countryFormats = map[string]countryFormat{
+	"US": {
+		PostalCode: regexp.MustCompile(`^\d{5}(-\d{4})?$`),
+		States: []string{
+			"AL", "AK", "AZ", "AR", "CA", "CO", "CT", "DE", "FL", "GA", "HI", "ID", "IL", "IN", "IA",
+			"KS", "KY", "LA", "ME", "MD", "MA", "MI", "MN", "MS", "MO", "MT", "NE", "NV", "NH", "NJ",
+			"NM", "NY", "NC", "ND", "OH", "OK", "OR", "PA", "RI", "SC", "SD", "TN", "TX", "UT", "VT",
+			"VA", "WA", "WV", "WI", "WY", "DC",
+			// Territories and military post offices
+			"AS", "GU", "MP", "PR", "VI", "AA", "AE", "AP",
+		},
+	},
+	"CA": {
+		PostalCode: regexp.MustCompile(`^[A-Z]\d[A-Z] ?\d[A-Z]\d$`),
+		States:     []string{"AB", "BC", "MB", "NB", "NL", "NS", "NT", "NU", "ON", "PE", "QC", "SK", "YT"},
+	},
+	"AU": {
+		PostalCode: regexp.MustCompile(`^\d{4}$`),
+		States:     []string{"ACT", "NSW", "NT", "QLD", "SA", "TAS", "VIC", "WA"},
+	},
+	"GB": {PostalCode: regexp.MustCompile(`^[A-Z]{1,2}\d[A-Z\d]? ?\d[A-Z]{2}$`)},
+	"DE": {PostalCode: regexp.MustCompile(`^\d{5}$`)},
+	"FR": {PostalCode: regexp.MustCompile(`^\d{5}$`)},
+	"NL": {PostalCode: regexp.MustCompile(`^\d{4} ?[A-Z]{2}$`)},
+	"JP": {PostalCode: regexp.MustCompile(`^\d{3}-?\d{4}$`)},
+}
+
+var countryCode = regexp.MustCompile(`^[A-Z]{2}$`)
+
+// Check the name, phone and address a customer wants their order shipped to,
+// after trimming them and normalizing the phone, country, state and postal
+// code in place. Returns nothing if the order can be shipped there.
+func validateAddress(client_info *ClientInfo) []AddressError {
+	errs := []AddressError{}
+	add := func(field string, err error) {
+		errs = append(errs, AddressError{Field: field, Error: err.Error()})
+	}
+
+	client_info.Name = strings.TrimSpace(client_info.Name)
+	checkField(add, "name", client_info.Name)
+
+	// The phone number is optional, but a wrong one is worse than none
+	if client_info.Phone = strings.TrimSpace(client_info.Phone); client_info.Phone != "" {
+		if phone, ok := normalizePhone(client_info.Phone); ok {
+			client_info.Phone = phone
+		} else {
+			add("phone", error_messages.ErrInvalidPhone)
+		}
+	}
+
+	address := client_info.Address
+	if address == nil {
+		add("address", error_messages.ErrAddressMissing)
+		return errs
+	}
+	address.Line1 = strings.TrimSpace(address.Line1)
+	address.Line2 = strings.TrimSpace(address.Line2)
+	address.City = strings.TrimSpace(address.City)
+	address.Country = strings.ToUpper(strings.TrimSpace(address.Country))
+	address.State = strings.ToUpper(strings.TrimSpace(address.State))
+	address.PostalCode = strings.ToUpper(strings.TrimSpace(address.PostalCode))
+
+	checkField(add, "address.line1", address.Line1)
+	if len(address.Line2) > maxAddressField {
+		add("address.line2", error_messages.ErrAddressTooLong)
+	}
+	checkField(add, "address.city", address.City)
+
+	switch {
+	case address.Country == "":
+		add("address.country", error_messages.ErrAddressMissing)
+		return errs
+	case !countryCode.MatchString(address.Country):
+		add("address.country", error_messages.ErrInvalidCountry)
+		return errs
+	case !shipsTo(address.Country):
+		add("address.country", error_messages.ErrCountryNotShipped)
+		return errs
+	}
+
+	format := countryFormats[address.Country]
+	switch {
+	case len(format.States) == 0:
+		if len(address.State) > maxAddressField {
+			add("address.state", error_messages.ErrAddressTooLong)
+		}
+	case address.State == "":
+		add("address.state", error_messages.ErrAddressMissing)
+	case !contains(format.States, address.State):
+		add("address.state", error_messages.ErrInvalidState)
+	}
+
+	switch {
+	case format.PostalCode == nil:
+		if len(address.PostalCode) > maxAddressField {
+			add("address.postal_code", error_messages.ErrAddressTooLong)
+		}
+	case address.PostalCode == "":
+		add("address.postal_code", error_messages.ErrAddressMissing)
+	case !format.PostalCode.MatchString(address.PostalCode):
+		add("address.postal_code", error_messages.ErrInvalidPostalCode)
+	}
+
+	return errs
+}
+
+func checkField(add func(string, error), field string, value string) {
+	if value == "" {
+		add(field, error_messages.ErrAddressMissing)
+	} else if len(value) > maxAddressField {
+		add(field, error_messages.ErrAddressTooLong)
+	}
+}
+
+// Whether orders may ship to a country under ALLOWED_COUNTRIES and
+// BLOCKED_COUNTRIES
+func shipsTo(country string) bool {
+	if contains(config.BLOCKED_COUNTRIES, country) {
+		return false
+	}
+	return len(config.ALLOWED_COUNTRIES) == 0 || contains(config.ALLOWED_COUNTRIES, country)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Remove a phone number that isn't valid from a paid order's address. The
+// phone is optional, so it isn't worth holding the order for. Returns the
+// number that was removed.
+func dropInvalidPhone(client_info *ClientInfo) string {
+	phone := strings.TrimSpace(client_info.Phone)
+	if phone == "" {
+		return ""
+	}
+	if _, ok := normalizePhone(phone); ok {
+		return ""
+	}
+	client_info.Phone = ""
+	return phone
+}
+
+// Why a paid order can't be shipped to its address, or an empty string if it
+// can
+func addressReviewReason(client_info *ClientInfo) string {
+	errs := validateAddress(client_info)
+	if len(errs) == 0 {
+		return ""
+	}
+	reasons := []string{}
+	for _, err := range errs {
+		reasons = append(reasons, fmt.Sprintf("%s: %s", err.Field, err.Error))
+	}
+	return "shipping address can't be used, " + strings.Join(reasons, "; ")
+}
@@ -0,0 +1,148 @@
+package external
+
+import (
+	"reflect"
+	"server/config"
+	"server/error_messages"
+	"strings"
+	"testing"
+)
+
+func TestValidateAddress(t *testing.T) {
+	defer func(allowed []string, blocked []string) {
+		config.ALLOWED_COUNTRIES, config.BLOCKED_COUNTRIES = allowed, blocked
+	}(config.ALLOWED_COUNTRIES, config.BLOCKED_COUNTRIES)
+
+	us := func() *Address {
+		return &Address{Line1: "1 Main St", City: "Springfield", State: "IL", PostalCode: "62701", Country: "US"}
+	}
+	with := func(change func(a *Address)) *Address {
+		a := us()
+		change(a)
+		return a
+	}
+	long := strings.Repeat("x", maxAddressField+1)
+
+	tests := []struct {
+		name    string
+		info    ClientInfo
+		allowed []string
+		blocked []string
+		want    []AddressError
+	}{
+		{
+			name: "valid",
+			info: ClientInfo{Name: "Mary Smith", Address: us()},
+		},
+		{
+			name: "ZIP+4",
+			info: ClientInfo{Name: "Mary Smith", Address: with(func(a *Address) { a.PostalCode = "62701-1234" })},
+		},
+		{
+			name: "Canadian postal code",
+			info: ClientInfo{Name: "Mary Smith", Address: &Address{Line1: "1 Main St", City: "Toronto", State: "on", PostalCode: "m5v 3l9", Country: "ca"}},
+		},
+		{
+			name: "country without a format",
+			info: ClientInfo{Name: "Mary Smith", Address: &Address{Line1: "Via Roma 1", City: "Roma", Country: "IT"}},
+		},
+		{
+			name: "missing fields",
+			info: ClientInfo{Name: " ", Address: &Address{Country: "US"}},
+			want: []AddressError{
+				{"name", error_messages.ErrAddressMissing.Error()},
+				{"address.line1", error_messages.ErrAddressMissing.Error()},
+				{"address.city", error_messages.ErrAddressMissing.Error()},
+				{"address.state", error_messages.ErrAddressMissing.Error()},
+				{"address.postal_code", error_messages.ErrAddressMissing.Error()},
+			},
+		},
+		{
+			name: "missing address",
+			info: ClientInfo{Name: "Mary Smith"},
+			want: []AddressError{{"address", error_messages.ErrAddressMissing.Error()}},
+		},
+		{
+			name: "too long",
+			info: ClientInfo{Name: long, Address: with(func(a *Address) { a.Line1, a.Line2 = long, long })},
+			want: []AddressError{
+				{"name", error_messages.ErrAddressTooLong.Error()},
+				{"address.line1", error_messages.ErrAddressTooLong.Error()},
+				{"address.line2", error_messages.ErrAddressTooLong.Error()},
+			},
+		},
+		{
+			name: "invalid state and ZIP",
+			info: ClientInfo{Name: "Mary Smith", Address: with(func(a *Address) { a.State, a.PostalCode = "XX", "6270" })},
+			want: []AddressError{
+				{"address.state", error_messages.ErrInvalidState.Error()},
+				{"address.postal_code", error_messages.ErrInvalidPostalCode.Error()},
+			},
+		},
+		{
+			name: "invalid phone",
+			info: ClientInfo{Name: "Mary Smith", Phone: "call me", Address: us()},
+			want: []AddressError{{"phone", error_messages.ErrInvalidPhone.Error()}},
+		},
+		{
+			name: "missing country",
+			info: ClientInfo{Name: "Mary Smith", Address: with(func(a *Address) { a.Country = "" })},
+			want: []AddressError{{"address.country", error_messages.ErrAddressMissing.Error()}},
+		},
+		{
+			name: "invalid country",
+			info: ClientInfo{Name: "Mary Smith", Address: with(func(a *Address) { a.Country = "USA" })},
+			want: []AddressError{{"address.country", error_messages.ErrInvalidCountry.Error()}},
+		},
+		{
+			name:    "country not allowed",
+			info:    ClientInfo{Name: "Mary Smith", Address: us()},
+			allowed: []string{"CA"},
+			want:    []AddressError{{"address.country", error_messages.ErrCountryNotShipped.Error()}},
+		},
+		{
+			name:    "country allowed",
+			info:    ClientInfo{Name: "Mary Smith", Address: us()},
+			allowed: []string{"CA", "US"},
+		},
+		{
+			name:    "country blocked",
+			info:    ClientInfo{Name: "Mary Smith", Address: us()},
+			blocked: []string{"US"},
+			want:    []AddressError{{"address.country", error_messages.ErrCountryNotShipped.Error()}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.ALLOWED_COUNTRIES, config.BLOCKED_COUNTRIES = tt.allowed, tt.blocked
+			want := tt.want
+			if want == nil {
+				want = []AddressError{}
+			}
+			if got := validateAddress(&tt.info); !reflect.DeepEqual(got, want) {
+				t.Errorf("validateAddress() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestValidateAddressNormalizes(t *testing.T) {
+	info := ClientInfo{
+		Name:    " Mary Smith ",
+		Phone:   "(217) 555-0123",
+		Address: &Address{Line1: " 1 Main St ", City: " Toronto", State: " on", PostalCode: "m5v 3l9 ", Country: "ca "},
+	}
+	if errs := validateAddress(&info); len(errs) != 0 {
+		t.Fatalf("validateAddress() = %v", errs)
+	}
+
+	want := ClientInfo{
+		Name:    "Mary Smith",
+		Phone:   "2175550123",
+		Address: &Address{Line1: "1 Main St", City: "Toronto", State: "ON", PostalCode: "M5V 3L9", Country: "CA"},
+	}
+	if info.Name != want.Name || info.Phone != want.Phone || *info.Address != *want.Address {
+		t.Errorf("got %+v %+v, want %+v %+v", info, *info.Address, want, *want.Address)
+	}
+}
@@ -0,0 +1,182 @@
+package external
+
+/* Sync the catalog's variants with the shop's products on Printify */
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"server/cart"
+	"server/catalog"
+	"server/notify"
+	"time"
+)
+
+type printifyProductPage struct {
+	CurrentPage int               `json:"current_page"`
+	LastPage    int               `json:"last_page"`
+	Data        []printifyProduct `json:"data"`
+}
+
+type printifyProduct struct {
+	ID       string `json:"id"`
+	Title    string `json:"title"`
+	Variants []struct {
+		ID          int    `json:"id"`
+		SKU         string `json:"sku"`
+		Price       int64  `json:"price"`
+		IsEnabled   bool   `json:"is_enabled"`
+		IsAvailable bool   `json:"is_available"`
+	} `json:"variants"`
+	Images []struct {
+		Src        string `json:"src"`
+		VariantIDs []int  `json:"variant_ids"`
+		IsDefault  bool   `json:"is_default"`
+	} `json:"images"`
+}
+
+// Load the last synced variants from the database, sync with Printify, then
+// keep syncing every interval in the background.
+func InitCatalogSync(interval time.Duration) {
+	stored, err := cart.Repo.AllPrintifyVariants()
+	if err != nil {
+		log.Printf("InitCatalogSync: Could not load stored Printify variants: %v\n", err)
+	} else if len(stored) > 0 {
+		catalog.SetPrintifyVariants(variantsBySKU(stored))
+	}
+
+	if err := SyncCatalog(); err != nil {
+		log.Printf("InitCatalogSync: Initial sync failed: %v\n", err)
+	}
+
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(interval) {
+			if err := SyncCatalog(); err != nil {
+				log.Printf("SyncCatalog: %v\n", err)
+			}
+		}
+	}()
+}
+
+// Pull every product in the shop from Printify, store the variants of all of
+// them that have a SKU and make them the source for validation and line items.
+// A sync that matches none of the catalog's SKUs, ex: an empty response, keeps
+// the variants from the last sync instead of marking every item unavailable.
+func SyncCatalog() error {
+	products, err := fetchPrintifyProducts()
+	if err != nil {
+		return err
+	}
+
+	variants := printifyVariants(products)
+
+	by_sku := variantsBySKU(variants)
+	matched, missing := 0, 0
+	for _, product := range catalog.Store.Products {
+		for _, variant := range product.Variants() {
+			if _, ok := by_sku[variant.SKU()]; !ok {
+				log.Printf("SyncCatalog: %s is in the catalog but not on Printify\n", variant.SKU())
+				missing++
+			} else {
+				matched++
+			}
+		}
+	}
+
+	if matched == 0 && missing > 0 {
+		notify.AlertOwner("catalog_sync", "no_match",
+			fmt.Sprintf("The Printify sync found %d variants in %d products but none of the catalog's %d SKUs, the last synced variants are kept", len(variants), len(products), missing))
+		return fmt.Errorf("no catalog SKU matched any of the %d Printify variants, keeping the last sync", len(variants))
+	}
+
+	if err := cart.Repo.ReplacePrintifyVariants(variants); err != nil {
+		return fmt.Errorf("storing variants: %w", err)
+	}
+	catalog.SetPrintifyVariants(by_sku)
+
+	log.Printf("SyncCatalog: Synced %d variants from %d products, %d catalog variants missing\n", len(variants), len(products), missing)
+	return nil
+}
+
+// The variants of the products that have a SKU. A SKU stays on the variant
+// that had it first, ex: when a product was duplicated on Printify, unless
+// only a later one is enabled. The variants it was taken from are logged.
+func printifyVariants(products []printifyProduct) []catalog.PrintifyVariant {
+	var variants []catalog.PrintifyVariant
+	index := map[string]int{}
+	for _, product := range products {
+		for _, v := range product.Variants {
+			if v.SKU == "" {
+				continue
+			}
+			variant := catalog.PrintifyVariant{
+				SKU:         v.SKU,
+				ProductID:   product.ID,
+				VariantID:   v.ID,
+				Price:       v.Price,
+				IsEnabled:   v.IsEnabled,
+				IsAvailable: v.IsAvailable,
+				Image:       variantImage(product, v.ID),
+			}
+
+			i, seen := index[v.SKU]
+			if !seen {
+				index[v.SKU] = len(variants)
+				variants = append(variants, variant)
+				continue
+			}
+			kept := variants[i]
+			if !kept.IsEnabled && variant.IsEnabled {
+				variants[i], kept, variant = variant, variant, kept
+			}
+			log.Printf("SyncCatalog: Duplicate SKU %s on variant %d of product %s ignored, using variant %d of product %s\n",
+				v.SKU, variant.VariantID, variant.ProductID, kept.VariantID, kept.ProductID)
+		}
+	}
+	return variants
+}
+
+func fetchPrintifyProducts() ([]printifyProduct, error) {
+	var products []printifyProduct
+	for page := 1; ; page++ {
+		var resp printifyProductPage
+		path := fmt.Sprintf("shops/%d/products.json?limit=50&page=%d", shop_id, page)
+		if err := printifyRequest(http.MethodGet, path, nil, &resp); err != nil {
+			return nil, err
+		}
+		products = append(products, resp.Data...)
+		if resp.LastPage <= page {
+			return products, nil
+		}
+	}
+}
+
+// Prefer the default mockup image for the variant, otherwise the first one.
+func variantImage(product printifyProduct, variant_id int) string {
+	src := ""
+	for _, image := range product.Images {
+		for _, id := range image.VariantIDs {
+			if id != variant_id {
+				continue
+			}
+			if image.IsDefault {
+				return image.Src
+			}
+			if src == "" {
+				src = image.Src
+			}
+		}
+	}
+	return src
+}
+
+func variantsBySKU(variants []catalog.PrintifyVariant) map[string]catalog.PrintifyVariant {
+	by_sku := map[string]catalog.PrintifyVariant{}
+	for _, v := range variants {
+		by_sku[v.SKU] = v
+	}
+	return by_sku
+}
@@ -0,0 +1,104 @@
+package external
+
+import (
+	"encoding/json"
+	"server/cart"
+	"server/catalog"
+	"testing"
+)
+
+func TestPrintifyVariants(t *testing.T) {
+	tests := []struct {
+		name     string
+		products string
+		want     []catalog.PrintifyVariant
+	}{
+		{
+			name: "variants without a SKU are skipped",
+			products: `[{"id": "p1", "variants": [
+				{"id": 1, "sku": "SHIRT-S", "price": 2000, "is_enabled": true, "is_available": true},
+				{"id": 2, "sku": "", "price": 2000, "is_enabled": true, "is_available": true}
+			]}]`,
+			want: []catalog.PrintifyVariant{
+				{SKU: "SHIRT-S", ProductID: "p1", VariantID: 1, Price: 2000, IsEnabled: true, IsAvailable: true},
+			},
+		},
+		{
+			name: "duplicated product keeps the first",
+			products: `[
+				{"id": "p1", "variants": [
+					{"id": 1, "sku": "SHIRT-S", "price": 2000, "is_enabled": true, "is_available": true},
+					{"id": 2, "sku": "SHIRT-M", "price": 2000, "is_enabled": true, "is_available": true}
+				], "images": [{"src": "p1.png", "variant_ids": [1, 2], "is_default": true}]},
+				{"id": "p2", "variants": [
+					{"id": 3, "sku": "SHIRT-S", "price": 2500, "is_enabled": true, "is_available": true},
+					{"id": 4, "sku": "SHIRT-M", "price": 2500, "is_enabled": true, "is_available": true}
+				], "images": [{"src": "p2.png", "variant_ids": [3, 4], "is_default": true}]}
+			]`,
+			want: []catalog.PrintifyVariant{
+				{SKU: "SHIRT-S", ProductID: "p1", VariantID: 1, Price: 2000, IsEnabled: true, IsAvailable: true, Image: "p1.png"},
+				{SKU: "SHIRT-M", ProductID: "p1", VariantID: 2, Price: 2000, IsEnabled: true, IsAvailable: true, Image: "p1.png"},
+			},
+		},
+		{
+			name: "enabled variant wins over a disabled one",
+			products: `[
+				{"id": "p1", "variants": [
+					{"id": 1, "sku": "SHIRT-S", "price": 2000, "is_enabled": false, "is_available": true},
+					{"id": 2, "sku": "SHIRT-M", "price": 2000, "is_enabled": true, "is_available": true}
+				]},
+				{"id": "p2", "variants": [
+					{"id": 3, "sku": "SHIRT-S", "price": 2500, "is_enabled": true, "is_available": false},
+					{"id": 4, "sku": "SHIRT-M", "price": 2500, "is_enabled": false, "is_available": true}
+				]}
+			]`,
+			want: []catalog.PrintifyVariant{
+				{SKU: "SHIRT-S", ProductID: "p2", VariantID: 3, Price: 2500, IsEnabled: true, IsAvailable: false},
+				{SKU: "SHIRT-M", ProductID: "p1", VariantID: 2, Price: 2000, IsEnabled: true, IsAvailable: true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var products []printifyProduct
+			if err := json.Unmarshal([]byte(tt.products), &products); err != nil {
+				t.Fatal(err)
+			}
+
+			got := printifyVariants(products)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d variants, want %d: %+v", len(got), len(tt.want), got)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("variant %d = %+v, want %+v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestStoreDuplicatedProductVariants(t *testing.T) {
+	useTestDatabase(t)
+
+	var products []printifyProduct
+	err := json.Unmarshal([]byte(`[
+		{"id": "p1", "variants": [{"id": 1, "sku": "SHIRT-S", "price": 2000, "is_enabled": true, "is_available": true}]},
+		{"id": "p2", "variants": [{"id": 2, "sku": "SHIRT-S", "price": 2000, "is_enabled": true, "is_available": true}]}
+	]`), &products)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cart.Repo.ReplacePrintifyVariants(printifyVariants(products)); err != nil {
+		t.Fatalf("ReplacePrintifyVariants() = %v", err)
+	}
+	stored, err := cart.Repo.AllPrintifyVariants()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 1 || stored[0].ProductID != "p1" {
+		t.Errorf("stored %+v, want SHIRT-S of p1", stored)
+	}
+}
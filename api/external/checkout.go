@@ -0,0 +1,337 @@
+package external
+
+/* Checkout: validate the cart, lock in prices and prepare the PaymentIntent */
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"server/cart"
+	"server/error_messages"
+	"server/session"
+
+	"github.com/gorilla/csrf"
+	"github.com/stripe/stripe-go/v74"
+	"github.com/stripe/stripe-go/v74/paymentintent"
+)
+
+type CheckoutSummary struct {
+	Status       string      `json:"status"`
+	Items        []ItemPrice `json:"items"`
+	Quantity     int64       `json:"quantity"`
+	Subtotal     string      `json:"subtotal"`
+	Discount     string      `json:"discount"`
+	PromoCode    string      `json:"promo_code,omitempty"`
+	Total        string      `json:"total"`
+	ClientSecret string      `json:"clientSecret"`
+}
+
+// A cart item that can't be checked out as is
+type CheckoutIssue struct {
+	Item   string `json:"id"`
+	Size   string `json:"size"`
+	Color  string `json:"color"`
+	Reason string `json:"reason"`
+}
+
+func handleCheckout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	session_id, err := session.BeginSession(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("handleCheckout: Error beginning session: %v\n", err)
+		return
+	}
+	items, err := session.RetrieveItems(session_id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("handleCheckout: Error retrieving items for session id: %s\n", session_id)
+		return
+	}
+
+	if len(items) == 0 {
+		http.Error(w, "Cart is empty", http.StatusBadRequest)
+		log.Printf("handleCheckout: Empty cart for session id: %s\n", session_id)
+		return
+	}
+
+	if issues := validateCart(items); len(issues) > 0 {
+		log.Printf("handleCheckout: %d invalid items in cart for session id: %s\n", len(issues), session_id)
+		w.Header().Set("X-CSRF-Token", csrf.Token(r))
+		writeJSON(w, http.StatusConflict, struct {
+			Status string          `json:"status"`
+			Issues []CheckoutIssue `json:"issues"`
+		}{
+			Status: "invalid_cart",
+			Issues: issues,
+		})
+		return
+	}
+
+	// Lock the current catalog prices into the cart so later catalog changes
+	// don't change what this checkout is charged.
+	for i := range items {
+		variant, _ := items[i].Variant()
+		items[i].UnitPrice = variant.Price()
+		if err := cart.Repo.LockItemPrice(items[i].ID, items[i].UnitPrice); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Printf("handleCheckout: Error locking price of item %d: %v\n", items[i].ID, err)
+			return
+		}
+	}
+
+	// A promo code that stopped applying since it was added is removed, and
+	// the customer is shown the cart without it before paying.
+	amounts, err := cart.CartAmounts(items, 0, session.RetrievePromoCode(session_id), "")
+	if cart.IsPromoError(err) {
+		log.Printf("handleCheckout: Removing promo code from cart %d: %v\n", items[0].ShoppingCartID, err)
+		if err := cart.Repo.UpdateCartPromoCode(items[0].ShoppingCartID, ""); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("X-CSRF-Token", csrf.Token(r))
+		writeJSON(w, http.StatusConflict, struct {
+			Status string          `json:"status"`
+			Issues []CheckoutIssue `json:"issues"`
+		}{
+			Status: "invalid_cart",
+			Issues: []CheckoutIssue{{Reason: err.Error()}},
+		})
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("handleCheckout: Error in CartAmounts(): %v\n", err)
+		return
+	}
+
+	item_prices, err := formItemPrices(items)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("handleCheckout: Error in formItemPrices(): %v\n", err)
+		return
+	}
+
+	pi, err := createOrUpdatePaymentIntent(session_id, amounts.Total)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("handleCheckout: PaymentIntent error: %v\n", err)
+		return
+	}
+
+	if _, err := saveOrderSnapshot(pi.ID, items, amounts, false); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("handleCheckout: Error saving order snapshot for %s: %v\n", pi.ID, err)
+		return
+	}
+
+	// Lock the cart until the payment succeeds, fails or is canceled
+	if err := cart.Repo.UpdateCartState(items[0].ShoppingCartID, cart.CartCheckingOut); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("handleCheckout: Error locking cart %d: %v\n", items[0].ShoppingCartID, err)
+		return
+	}
+
+	log.Printf("SessionID %s, PaymentIntent %s cart total (without shipping): %d\n", session_id, pi.ID, amounts.Total)
+
+	w.Header().Set("X-CSRF-Token", csrf.Token(r))
+	writeJSON(w, http.StatusOK, CheckoutSummary{
+		Status:       string(pi.Status),
+		Items:        item_prices,
+		Quantity:     cart.TotalQuantity(items),
+		Subtotal:     fmt.Sprintf("%.2f", float64(amounts.Subtotal)/100),
+		Discount:     fmt.Sprintf("%.2f", float64(amounts.Discount)/100),
+		PromoCode:    amounts.PromoCode,
+		Total:        fmt.Sprintf("%.2f", float64(amounts.Total)/100),
+		ClientSecret: pi.ClientSecret,
+	})
+}
+
+// Check every item against the current catalog
+func validateCart(items []cart.CartItem) []CheckoutIssue {
+	issues := []CheckoutIssue{}
+	for _, item := range items {
+		issue := CheckoutIssue{Item: item.Item, Size: item.Size, Color: item.Color}
+		variant, err := item.Variant()
+		switch {
+		case err != nil:
+			issue.Reason = error_messages.ErrInvalidItem.Error()
+		case !variant.Available():
+			issue.Reason = error_messages.ErrUnavailableItem.Error()
+		case item.Quantity < 1:
+			issue.Reason = "invalid quantity"
+		default:
+			continue
+		}
+		issues = append(issues, issue)
+	}
+
+	if cart.TotalQuantity(items) > cart.MaxQuantity {
+		issues = append(issues, CheckoutIssue{Reason: "too many items"})
+	}
+
+	return issues
+}
+
+// Update the amount of the session's PaymentIntent, or create a new one if the
+// session has none or the existing one was canceled. A PaymentIntent that
+// can't be updated because it is being paid, or already was, is never
+// replaced, that would let the customer pay twice.
+func createOrUpdatePaymentIntent(session_id string, amount int64) (*stripe.PaymentIntent, error) {
+	paymentintent_id, err := session.RetrievePaymentIntentID(session_id)
+	if err != nil {
+		return nil, err
+	}
+
+	if paymentintent_id != "" {
+		pi, err := updatePaymentIntentAmount(paymentintent_id, amount)
+		if err == nil {
+			return pi, nil
+		}
+
+		existing, get_err := paymentintent.Get(paymentintent_id, nil)
+		if get_err != nil {
+			log.Printf("createOrUpdatePaymentIntent: Could not retrieve %s: %v\n", paymentintent_id, get_err)
+			return nil, err
+		}
+		if existing.Status != stripe.PaymentIntentStatusCanceled {
+			return nil, fmt.Errorf("could not update %s, it is %s: %w", paymentintent_id, existing.Status, err)
+		}
+		log.Printf("createOrUpdatePaymentIntent: %s was canceled, creating a new PaymentIntent\n", paymentintent_id)
+	}
+
+	params := &stripe.PaymentIntentParams{
+		Amount:   stripe.Int64(amount),
+		Currency: stripe.String(string(stripe.CurrencyUSD)),
+		AutomaticPaymentMethods: &stripe.PaymentIntentAutomaticPaymentMethodsParams{
+			Enabled: stripe.Bool(true),
+		},
+	}
+	pi, err := paymentintent.New(params)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := session.AddPaymentIntentID(session_id, pi.ID); err != nil {
+		return nil, err
+	}
+
+	return pi, nil
+}
+
+/* Cancel the PaymentIntent in flight so the customer can change their cart */
+func handleCheckoutCancel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	session_id, err := session.BeginSession(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("handleCheckoutCancel: Error beginning session: %v\n", err)
+		return
+	}
+	shopping_cart, err := cart.Repo.GetCartBySessionID(session_id)
+	if err != nil || shopping_cart.State != cart.CartCheckingOut {
+		// Nothing to cancel
+		w.Header().Set("X-CSRF-Token", csrf.Token(r))
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Successful Request"))
+		return
+	}
+
+	pi, err := paymentintent.Cancel(shopping_cart.PaymentIntentID, nil)
+	if err != nil {
+		// Most likely the payment is already processing or has succeeded
+		http.Error(w, "Payment can no longer be canceled", http.StatusConflict)
+		log.Printf("handleCheckoutCancel: Could not cancel %s: %v\n", shopping_cart.PaymentIntentID, err)
+		return
+	}
+
+	reopenCart(pi.ID, true)
+
+	w.Header().Set("X-CSRF-Token", csrf.Token(r))
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Successful Request"))
+}
+
+// Reopen a cart that is still checking out when its customer changes it.
+// Stripe never cancels idle PaymentIntents, so a customer who left the payment
+// form would otherwise be locked out of their cart until the session expires.
+// The PaymentIntent is canceled unless it is already being paid. Returns
+// whether the cart is open.
+func UnlockCart(shopping_cart *cart.ShoppingCart) bool {
+	if shopping_cart.State != cart.CartCheckingOut {
+		return shopping_cart.State == cart.CartOpen
+	}
+
+	if shopping_cart.PaymentIntentID == "" {
+		if err := cart.Repo.UpdateCartState(shopping_cart.ID, cart.CartOpen); err != nil {
+			log.Printf("UnlockCart: Could not reopen cart %d: %v\n", shopping_cart.ID, err)
+			return false
+		}
+		shopping_cart.State = cart.CartOpen
+		return true
+	}
+
+	pi, err := paymentintent.Get(shopping_cart.PaymentIntentID, nil)
+	if err != nil {
+		log.Printf("UnlockCart: Could not retrieve %s: %v\n", shopping_cart.PaymentIntentID, err)
+		return false
+	}
+
+	switch pi.Status {
+	case stripe.PaymentIntentStatusProcessing, stripe.PaymentIntentStatusSucceeded,
+		stripe.PaymentIntentStatusRequiresCapture:
+		return false
+	case stripe.PaymentIntentStatusCanceled:
+	default:
+		if pi, err = paymentintent.Cancel(pi.ID, nil); err != nil {
+			log.Printf("UnlockCart: Could not cancel %s: %v\n", shopping_cart.PaymentIntentID, err)
+			return false
+		}
+	}
+
+	reopenCart(pi.ID, true)
+	shopping_cart.State = cart.CartOpen
+	shopping_cart.PaymentIntentID = ""
+	return true
+}
+
+// Unlock the cart of a PaymentIntent that failed or was canceled. Canceled
+// PaymentIntents can't be used again, so their order is canceled as well and
+// the next checkout creates a new PaymentIntent.
+func reopenCart(payment_intent_id string, canceled bool) {
+	shopping_cart, err := cart.Repo.GetCartByPaymentIntentID(payment_intent_id)
+	if err != nil {
+		log.Printf("reopenCart: No cart for %s: %v\n", payment_intent_id, err)
+		return
+	}
+
+	if shopping_cart.State == cart.CartCheckingOut {
+		if err := cart.Repo.UpdateCartState(shopping_cart.ID, cart.CartOpen); err != nil {
+			log.Printf("reopenCart: Could not reopen cart %d: %v\n", shopping_cart.ID, err)
+			return
+		}
+		log.Printf("reopenCart: Reopened cart %d after %s\n", shopping_cart.ID, payment_intent_id)
+	}
+
+	if !canceled {
+		return
+	}
+
+	if err := cart.Repo.UpdatePaymentIntentID(shopping_cart.SessionID, ""); err != nil {
+		log.Printf("reopenCart: Could not clear %s from cart %d: %v\n", payment_intent_id, shopping_cart.ID, err)
+	}
+
+	order, err := cart.Repo.GetOrderByPaymentIntentID(payment_intent_id)
+	if err == nil && order.Status == cart.OrderPendingPayment {
+		if err := cart.Repo.UpdateOrderStatus(order.ID, cart.OrderCanceled); err != nil {
+			log.Printf("reopenCart: Could not cancel order %d: %v\n", order.ID, err)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package external
+
+/* Keep the orders table in step with checkout and payment */
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"server/cart"
+	"server/error_messages"
+	"server/session"
+	"text/tabwriter"
+	"time"
+
+	"github.com/stripe/stripe-go/v74"
+)
+
+// Snapshot the cart items and amounts into the PaymentIntent's order, which
+// stays pending_payment until Stripe tells us the payment succeeded.
+// shipping_priced is false until shipping was quoted for the items.
+func saveOrderSnapshot(payment_intent_id string, items []cart.CartItem, amounts *cart.Amounts, shipping_priced bool) (*cart.Order, error) {
+	if len(items) == 0 {
+		return nil, error_messages.ErrNotExists
+	}
+
+	order_items, err := cart.NewOrderItems(items)
+	if err != nil {
+		return nil, err
+	}
+
+	shipping_method := amounts.ShippingMethod
+	if shipping_method == "" {
+		shipping_method = defaultShippingMethod
+	}
+
+	return cart.Repo.SaveOrderSnapshot(&cart.Order{
+		ShoppingCartID:  items[0].ShoppingCartID,
+		PaymentIntentID: payment_intent_id,
+		Subtotal:        amounts.Subtotal,
+		Shipping:        amounts.Shipping,
+		ShippingMethod:  shipping_method,
+		Discount:        amounts.Discount,
+		PromoCode:       amounts.PromoCode,
+		Tax:             amounts.Tax,
+		Total:           amounts.Total,
+		ShippingPriced:  shipping_priced,
+		Items:           order_items,
+	})
+}
+
+// Return the PaymentIntent's order, creating it from the cart for carts that
+// were checked out before the order was snapshotted.
+func retrievePaymentIntentOrder(payment_intent_id string) (*cart.Order, error) {
+	order, err := cart.Repo.GetOrderByPaymentIntentID(payment_intent_id)
+	if err != error_messages.ErrNotExists {
+		return order, err
+	}
+
+	log.Printf("retrievePaymentIntentOrder: No order for %s, creating one from the cart\n", payment_intent_id)
+	items, err := session.RetrievePaymentIntentItems(payment_intent_id)
+	if err != nil {
+		return nil, err
+	}
+	amounts, err := cart.CartAmounts(items, 0, "", "")
+	if err != nil {
+		return nil, err
+	}
+	return saveOrderSnapshot(payment_intent_id, items, amounts, false)
+}
+
+// Check a successful payment against the order snapshot. Returns why the order
+// needs review, or an empty string if it can be fulfilled.
+func verifyPayment(order *cart.Order, payment_intent stripe.PaymentIntent) string {
+	var items_total int64 = 0
+	for _, item := range order.Items {
+		items_total += item.UnitPrice * item.Quantity
+	}
+
+	switch {
+	case len(order.Items) == 0:
+		return "order has no items"
+	case items_total != order.Subtotal:
+		return fmt.Sprintf("items add up to %d but the subtotal is %d", items_total, order.Subtotal)
+	case order.Discount < 0 || order.Discount > order.Subtotal+order.Shipping:
+		return fmt.Sprintf("discount %d is more than the order", order.Discount)
+	case order.Tax < 0:
+		return fmt.Sprintf("tax %d is negative", order.Tax)
+	case order.Subtotal+order.Shipping-order.Discount+order.Tax != order.Total:
+		return fmt.Sprintf("subtotal %d, shipping %d, discount %d and tax %d don't add up to the total %d",
+			order.Subtotal, order.Shipping, order.Discount, order.Tax, order.Total)
+	case !order.ShippingPriced:
+		return "shipping was never priced"
+	case payment_intent.Currency != stripe.CurrencyUSD:
+		return fmt.Sprintf("paid in %s", payment_intent.Currency)
+	case payment_intent.Amount != order.Total:
+		return fmt.Sprintf("paid %d but the order total is %d", payment_intent.Amount, order.Total)
+	}
+
+	// The cart may have changed in another tab after the snapshot was priced
+	items, err := session.RetrievePaymentIntentItems(payment_intent.ID)
+	if err != nil {
+		log.Printf("verifyPayment: Could not compare order %d with its cart: %v\n", order.ID, err)
+		return fmt.Sprintf("could not compare with cart: %v", err)
+	}
+	current, err := cart.NewOrderItems(items)
+	if err != nil || !sameOrderItems(current, order.Items) {
+		return "cart changed after it was priced"
+	}
+
+	return ""
+}
+
+func sameOrderItems(a []cart.OrderItem, b []cart.OrderItem) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Item != b[i].Item || a[i].Size != b[i].Size || a[i].Color != b[i].Color ||
+			a[i].Quantity != b[i].Quantity || a[i].UnitPrice != b[i].UnitPrice {
+			return false
+		}
+	}
+	return true
+}
+
+// Count the order's promo code as used now that its payment was verified.
+// Returns why the order needs review if orders paid since it was priced used
+// the code up, or already used it with the same email. Without enforce_limits
+// the use is counted regardless, for orders the owner approved.
+func redeemPromoCode(order *cart.Order, enforce_limits bool) string {
+	if order.PromoCode == "" {
+		return ""
+	}
+
+	err := cart.Repo.RedeemPromoCode(order, enforce_limits)
+	switch err {
+	case nil:
+		cart.Repo.AddOrderEvent(order.ID, "promo_redeemed", fmt.Sprintf("%s for %d", order.PromoCode, order.Discount))
+	case error_messages.ErrDuplicate:
+	case error_messages.ErrPromoUsedUp, error_messages.ErrPromoAlreadyUsed:
+		return fmt.Sprintf("promo code %s: %v", order.PromoCode, err)
+	default:
+		log.Printf("redeemPromoCode: Could not record %s for order %d: %v\n", order.PromoCode, order.ID, err)
+	}
+	return ""
+}
+
+// Release an order held for review to be submitted
+func ApproveOrder(order_id int64) error {
+	if err := cart.Repo.UpdateOrderStatus(order_id, cart.OrderPaid); err != nil {
+		return err
+	}
+	log.Printf("ApproveOrder: Order %d approved\n", order_id)
+
+	// Held orders didn't use their promo code yet
+	if order, err := cart.Repo.GetOrderByID(order_id); err == nil {
+		redeemPromoCode(order, false)
+	}
+	return enqueueOrderSubmission(order_id)
+}
+
+// Write an order's audit trail and shipments to w, for the -order-events flag
+func ListOrderEvents(w io.Writer, order_id int64) error {
+	order, err := cart.Repo.GetOrderByID(order_id)
+	if err != nil {
+		return err
+	}
+	events, err := cart.Repo.GetOrderEvents(order_id)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "Order %d (%s) is %s, refunded %d of %d\n", order.ID, order.PaymentIntentID, order.Status, order.Refunded, order.Total)
+	if order.DisputeStatus != "" {
+		fmt.Fprintf(w, "Dispute: %s\n", order.DisputeStatus)
+	}
+
+	shipments, err := cart.Repo.GetOrderShipments(order_id)
+	if err != nil {
+		return err
+	}
+	for _, shipment := range shipments {
+		fmt.Fprintf(w, "Shipment: %s %s %s\n", shipment.Carrier, shipment.TrackingNumber, shipment.TrackingURL)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tEVENT\tDETAIL")
+	for _, event := range events {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", event.CreatedAt.Format(time.RFC3339), event.Event, event.Detail)
+	}
+	return tw.Flush()
+}
+
+func customerFromClientInfo(client_info *ClientInfo) cart.Customer {
+	customer := cart.Customer{
+		Name:  client_info.Name,
+		Email: client_info.Email,
+		Phone: client_info.Phone,
+	}
+	if client_info.Address != nil {
+		customer.Line1 = client_info.Address.Line1
+		customer.Line2 = client_info.Address.Line2
+		customer.City = client_info.Address.City
+		customer.State = client_info.Address.State
+		customer.PostalCode = client_info.Address.PostalCode
+		customer.Country = client_info.Address.Country
+	}
+	return customer
+}
+
+// Rebuild the ClientInfo an order was paid with from the stored customer
+func clientInfoFromOrder(order *cart.Order) *ClientInfo {
+	return &ClientInfo{
+		PaymentIntentID: order.PaymentIntentID,
+		Name:            order.Customer.Name,
+		Email:           order.Customer.Email,
+		Phone:           order.Customer.Phone,
+		Address: &Address{
+			Line1:      order.Customer.Line1,
+			Line2:      order.Customer.Line2,
+			City:       order.Customer.City,
+			Country:    order.Customer.Country,
+			PostalCode: order.Customer.PostalCode,
+			State:      order.Customer.State,
+		},
+	}
+}
@@ -3,42 +3,105 @@ package external
 /* Handle Printify API connection and calls */
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"math"
+	"net/http"
 	"server/cart"
+	"server/error_messages"
+	"server/jobs"
+	"server/notify"
+	"server/shipping"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	go_printify "github.com/ericdbishop/go-printify"
 )
 
+const (
+	printifyBaseURL = "https://api.printify.com/v1/"
+	submitOrderJob  = "submit_order"
+)
+
 var (
-	client  *go_printify.Client
-	shop_id int
+	client         *go_printify.Client
+	shop_id        int
+	printify_token string
+	printify_http  = &http.Client{Timeout: 30 * time.Second}
 )
 
 func InitPrintifyClient(api_token string, shopID int) {
 	client = go_printify.NewClient(api_token)
 	client.UserAgent = "Go"
 	shop_id = shopID
+	printify_token = api_token
+
+	jobs.Register(submitOrderJob, handleSubmitOrderJob)
+}
+
+// Make a Printify API request directly for responses go_printify can't decode,
+// such as products whose ids are strings. v may be nil to discard the body.
+func printifyRequest(method string, path string, body interface{}, v interface{}) error {
+	var buf io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		buf = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, printifyBaseURL+path, buf)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json;charset=utf-8")
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", "Go")
+	req.Header.Set("Authorization", "Bearer "+printify_token)
+
+	resp, err := printify_http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("printify %s %s: %d %s", method, path, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
 }
 
 // Initializes an Order struct for use with go_printify
-func formOrderShipping(items []cart.CartItem, client_info *ClientInfo) *go_printify.OrderSubmission {
+func formOrderShipping(items []cart.CartItem, client_info *ClientInfo) (*go_printify.OrderSubmission, error) {
 	line_items := []*go_printify.LineItem{}
 
-	for _, item := range items {
-		SKU := item.GetSKU()
-		var line_item *go_printify.LineItem = &go_printify.LineItem{
-			Sku:      &SKU,
-			Quantity: 1,
+	// Identical variants are sent as one line item with the combined quantity
+	for _, item := range cart.AggregateItems(items) {
+		line_item, err := formLineItem(item)
+		if err != nil {
+			log.Printf("formOrderShipping: No line item for %s %s %s: %v\n", item.Item, item.Size, item.Color, err)
+			return nil, err
 		}
 		line_items = append(line_items, line_item)
 	}
 
-	full_name := strings.Split(client_info.Name, " ")
+	first_name, last_name := splitName(client_info.Name)
 
 	address_to := &go_printify.AddressTo{
-		FirstName: full_name[0],
+		FirstName: first_name,
+		LastName:  last_name,
 		Country:   client_info.Address.Country,
 		Region:    client_info.Address.State,
 		Address1:  client_info.Address.Line1,
@@ -46,8 +109,9 @@ func formOrderShipping(items []cart.CartItem, client_info *ClientInfo) *go_print
 		City:      client_info.Address.City,
 		Zip:       client_info.Address.PostalCode,
 	}
-	if len(full_name) > 1 {
-		address_to.LastName = full_name[1]
+	// Carriers call the recipient if there's a problem with the delivery
+	if phone, ok := normalizePhone(client_info.Phone); ok {
+		address_to.Phone = phone
 	}
 
 	order := &go_printify.OrderSubmission{
@@ -55,51 +119,280 @@ func formOrderShipping(items []cart.CartItem, client_info *ClientInfo) *go_print
 		AddressTo: address_to,
 	}
 
-	return order
+	return order, nil
 }
 
-func formOrderSubmission(items []cart.CartItem, client_info *ClientInfo) (*go_printify.OrderSubmission, error) {
-	order := formOrderShipping(items, client_info)
+// Use the synced Printify product and variant ids when we have them, otherwise
+// fall back to letting Printify match the catalog SKU.
+func formLineItem(item cart.CartItem) (*go_printify.LineItem, error) {
+	variant, err := item.Variant()
+	if err != nil {
+		return nil, err
+	}
 
-	order.AddressTo.Email = client_info.Email
+	line_item := &go_printify.LineItem{Quantity: int(item.Quantity)}
+	if pv, ok := variant.Printify(); ok {
+		line_item.ProductId = &pv.ProductID
+		line_item.VariantId = &pv.VariantID
+	} else {
+		SKU := variant.SKU()
+		line_item.Sku = &SKU
+	}
+
+	return line_item, nil
+}
 
-	// Order label will be the primary key of a new row in the order table
-	// padded out with 0's.
-	label_num, err := cart.Repo.CreateOrderEntry(items[0].ShoppingCartID)
+func formOrderSubmission(order_record *cart.Order, client_info *ClientInfo) (*go_printify.OrderSubmission, error) {
+	order, err := formOrderShipping(order_record.CartItems(), client_info)
 	if err != nil {
-		log.Printf("formOrderSubmission: Error in CreateOrderEntry(): %v\n", err)
 		return nil, err
 	}
-	order.Label = fmt.Sprintf("%05d", label_num)
+
+	order.AddressTo.Email = client_info.Email
+
+	if err := assignOrderLabel(order_record); err != nil {
+		return nil, err
+	}
+	order.Label = order_record.Label
 
 	shipping_notification := true
 	order.SendShippingNotification = &shipping_notification
-	order.ShippingMethod = 1
+	order.ShippingMethod = printifyShippingMethod(order_record.ShippingMethod)
 
 	return order, nil
 }
 
-func GetShippingCost(items []cart.CartItem, client_info *ClientInfo) int64 {
-	order := formOrderShipping(items, client_info)
+// Order label will be the primary key of a new row in the order table padded
+// out with 0's. Orders keep the label they were given first.
+func assignOrderLabel(order_record *cart.Order) error {
+	if order_record.Label != "" {
+		return nil
+	}
+
+	label_num, err := cart.Repo.CreateOrderEntry(order_record.ShoppingCartID)
+	if err != nil {
+		log.Printf("assignOrderLabel: Error in CreateOrderEntry(): %v\n", err)
+		return err
+	}
+	label := fmt.Sprintf("%05d", label_num)
+
+	if err := cart.Repo.UpdateOrderLabel(order_record.ID, label); err != nil {
+		log.Printf("assignOrderLabel: Could not store label %s for order %d: %v\n", label, order_record.ID, err)
+		return err
+	}
+	order_record.Label = label
+	return nil
+}
+
+// Alert the owner once this many quotes in a row fell back to the rate table
+const shippingFallbackAlert = 3
+
+var shipping_fallbacks atomic.Int64
+
+func shippingFallback(err error) {
+	if n := shipping_fallbacks.Add(1); n >= shippingFallbackAlert {
+		notify.AlertOwner("shipping_fallback", "printify", fmt.Sprintf("The last %d shipping quotes used the fallback rates, Printify returned: %v", n, err))
+	}
+}
+
+// A shipping method customers can choose, with the id Printify orders take as
+// shipping_method and the field Printify quotes it as
+type shippingMethod struct {
+	Method     string
+	Name       string
+	PrintifyID int
+	QuoteField string
+}
 
-	shipping_cost, err := client.CalculateShippingCosts(shop_id, order)
+const defaultShippingMethod = shipping.Standard
 
+// Offered in this order, the first available method is the default
+var shippingMethods = []shippingMethod{
+	{Method: shipping.Standard, Name: "Standard", PrintifyID: 1, QuoteField: "standard"},
+	{Method: "priority", Name: "Priority", PrintifyID: 2, QuoteField: "priority"},
+	{Method: "express", Name: "Express", PrintifyID: 3, QuoteField: "printify_express"},
+}
+
+// A shipping method and its price for the customer's items and address
+type ShippingOption struct {
+	Method string `json:"method"`
+	Name   string `json:"name"`
+	Price  string `json:"price"`
+	Cost   int64  `json:"-"`
+}
+
+// Quote every shipping method Printify offers for the items and address.
+// Quotes are cached for the same items and destination, and priced from the
+// fallback rate table if Printify can't quote.
+func GetShippingOptions(items []cart.CartItem, client_info *ClientInfo) ([]ShippingOption, shipping.Source) {
+	fallback := func() ([]ShippingOption, shipping.Source) {
+		costs := shipping.Rates.Costs(client_info.Address.Country, cart.TotalQuantity(items))
+		return shippingOptions(costs), shipping.Fallback
+	}
+
+	order, err := formOrderShipping(items, client_info)
+	if err != nil {
+		log.Printf("GetShippingOptions: Could not form order: %v\n", err)
+		return fallback()
+	}
+
+	key := quoteKey(order)
+	if costs, ok := shipping.Quotes.Get(key); ok {
+		return shippingOptions(costs), shipping.Cached
+	}
+
+	quote, err := quoteShipping(order)
 	if err != nil {
 		// Give it another ole' college try
-		shipping_cost, err = client.CalculateShippingCosts(shop_id, order)
+		quote, err = quoteShipping(order)
 		if err != nil {
-			log.Printf("GetShippingCost: Error calculating shipping cost: client.CalculateShippingCosts(): %v\n", err)
-			return 850
+			log.Printf("GetShippingOptions: Error calculating shipping cost: quoteShipping(): %v\n", err)
+			shippingFallback(err)
+			return fallback()
+		}
+	}
+	shipping_fallbacks.Store(0)
+
+	costs := map[string]int64{}
+	for _, method := range shippingMethods {
+		// Methods the print providers can't ship with are quoted as 0 or left out
+		if cost := quote[method.QuoteField]; cost > 0 {
+			costs[method.Method] = int64(math.Round(cost))
+		}
+	}
+	if len(costs) == 0 {
+		log.Printf("GetShippingOptions: Printify quoted no shipping methods: %v\n", quote)
+		return fallback()
+	}
+
+	shipping.Quotes.Put(key, costs)
+	return shippingOptions(costs), shipping.Live
+}
+
+// go_printify's CalculateShippingCosts only decodes standard and express
+func quoteShipping(order *go_printify.OrderSubmission) (map[string]float64, error) {
+	quote := map[string]float64{}
+	err := printifyRequest(http.MethodPost, fmt.Sprintf("shops/%d/orders/shipping.json", shop_id), order, &quote)
+	return quote, err
+}
+
+// The cache key of a quote for the order's line items and destination
+func quoteKey(order *go_printify.OrderSubmission) string {
+	items := []string{}
+	for _, line_item := range order.LineItems {
+		if line_item.Sku != nil {
+			items = append(items, fmt.Sprintf("%s x%d", *line_item.Sku, line_item.Quantity))
+		} else {
+			items = append(items, fmt.Sprintf("%s/%d x%d", *line_item.ProductId, *line_item.VariantId, line_item.Quantity))
 		}
 	}
+	return shipping.QuoteKey(items, order.AddressTo.Country, order.AddressTo.Region)
+}
 
-	var cost int64 = int64(shipping_cost.Standard)
+// The options for the methods we offer out of costs by method
+func shippingOptions(costs map[string]int64) []ShippingOption {
+	options := []ShippingOption{}
+	for _, method := range shippingMethods {
+		cost, ok := costs[method.Method]
+		if !ok {
+			continue
+		}
+		options = append(options, ShippingOption{
+			Method: method.Method,
+			Name:   method.Name,
+			Price:  fmt.Sprintf("%.2f", float64(cost)/100),
+			Cost:   cost,
+		})
+	}
+	return options
+}
 
-	return cost
+// The option for the method the customer chose, or the first one if it isn't
+// offered for their items and address
+func selectShippingOption(options []ShippingOption, method string) ShippingOption {
+	for _, option := range options {
+		if option.Method == method {
+			return option
+		}
+	}
+	return options[0]
 }
 
-func submitOrder(items []cart.CartItem, client_info *ClientInfo) error {
-	order, err := formOrderSubmission(items, client_info)
+// The shipping_method id of a Printify order for a method name, orders
+// snapshotted before methods could be chosen ship standard
+func printifyShippingMethod(method string) int {
+	for _, m := range shippingMethods {
+		if m.Method == method {
+			return m.PrintifyID
+		}
+	}
+	return shippingMethods[0].PrintifyID
+}
+
+// Submit the order to Printify and store the Printify order id. The order is
+// marked submitted on success and submission_failed otherwise so it can be
+// retried with RetryFailedSubmissions.
+func submitOrder(order_record *cart.Order, client_info *ClientInfo) error {
+	err := sendOrder(order_record, client_info)
+	if err != nil {
+		if order_record.Status != cart.OrderSubmissionFailed {
+			if err := cart.Repo.UpdateOrderStatus(order_record.ID, cart.OrderSubmissionFailed); err != nil {
+				log.Printf("submitOrder: Could not mark order %d as failed: %v\n", order_record.ID, err)
+			}
+			order_record.Status = cart.OrderSubmissionFailed
+		}
+		alertSubmissionFailed(order_record, err)
+		return err
+	}
+
+	if err := cart.Repo.UpdateOrderStatus(order_record.ID, cart.OrderSubmitted); err != nil {
+		return withdrawSubmission(order_record, err)
+	}
+	order_record.Status = cart.OrderSubmitted
+	return nil
+}
+
+// One alert covers every order Printify rejects, so an outage doesn't send one
+// per order
+func alertSubmissionFailed(order_record *cart.Order, err error) {
+	message := fmt.Sprintf("Printify didn't accept paid order %d, it will be retried: %v", order_record.ID, err)
+	if failed, err := cart.Repo.GetOrdersByStatus(cart.OrderSubmissionFailed); err == nil {
+		message += fmt.Sprintf(". %d orders are waiting to be resubmitted.", len(failed))
+	}
+	notify.AlertOwner("submission_failed", "printify", message)
+}
+
+// The order reached Printify but couldn't be marked submitted. If it was
+// refunded or canceled while it was being sent, the Printify order is canceled
+// so it isn't made, otherwise err is returned to retry the status update.
+func withdrawSubmission(order_record *cart.Order, err error) error {
+	current, get_err := cart.Repo.GetOrderByID(order_record.ID)
+	if get_err != nil {
+		return err
+	}
+	if current.Status.CanTransition(cart.OrderSubmitted) {
+		return err
+	}
+
+	log.Printf("submitOrder: Order %d became %s while it was submitted, canceling Printify order %s\n", current.ID, current.Status, order_record.PrintifyOrderID)
+	if err := cancelPrintifyOrder(order_record.PrintifyOrderID); err != nil {
+		cart.Repo.AddOrderEvent(current.ID, "printify_cancel_failed", err.Error())
+		notify.AlertOwner("printify_cancel_failed", fmt.Sprint(current.ID),
+			fmt.Sprintf("Order %d is %s but could not be canceled on Printify (order %s), cancel it by hand: %v", current.ID, current.Status, order_record.PrintifyOrderID, err))
+		return nil
+	}
+	cart.Repo.AddOrderEvent(current.ID, "printify_canceled", order_record.PrintifyOrderID)
+	return nil
+}
+
+func sendOrder(order_record *cart.Order, client_info *ClientInfo) error {
+	// A previous attempt reached Printify but failed to update the status
+	if order_record.PrintifyOrderID != "" {
+		log.Printf("sendOrder: Order %d already has Printify order id %s\n", order_record.ID, order_record.PrintifyOrderID)
+		return nil
+	}
+
+	order, err := formOrderSubmission(order_record, client_info)
 
 	if err != nil {
 		log.Printf("Error forming order struct: external.formOrderSubmission()\n")
@@ -108,7 +401,85 @@ func submitOrder(items []cart.CartItem, client_info *ClientInfo) error {
 
 	log.Printf("Submitting order for %s: %s", client_info.PaymentIntentID, order.Label)
 
-	client.SubmitOrder(shop_id, order)
+	// go_printify's SubmitOrder discards the response, which holds the id of
+	// the created order.
+	var created struct {
+		ID string `json:"id"`
+	}
+	err = printifyRequest(http.MethodPost, fmt.Sprintf("shops/%d/orders.json", shop_id), order, &created)
+	if err != nil {
+		log.Printf("sendOrder: Printify rejected order %s: %v\n", order.Label, err)
+		return err
+	}
+
+	log.Printf("Order %s submitted, Printify order id %s\n", order.Label, created.ID)
+
+	if err := cart.Repo.UpdatePrintifyOrderID(order_record.ID, created.ID); err != nil {
+		// The order exists on Printify, so don't report the submission as failed
+		log.Printf("sendOrder: Could not store Printify order id %s for order %d: %v\n", created.ID, order_record.ID, err)
+	}
+	order_record.PrintifyOrderID = created.ID
 
 	return nil
 }
+
+type submitOrderPayload struct {
+	OrderID int64 `json:"order_id"`
+}
+
+// Queue a paid order to be submitted to Printify by the job worker. An order
+// only ever gets one submission job, which retries on its own.
+func enqueueOrderSubmission(order_id int64) error {
+	_, err := jobs.EnqueueOnce(submitOrderJob, submitOrderPayload{OrderID: order_id})
+	return err
+}
+
+func handleSubmitOrderJob(payload []byte) error {
+	var p submitOrderPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+
+	// Checks the order is still paid and keeps a refund from being missed
+	// while it is sent, see withdrawSubmission
+	err := cart.Repo.ClaimOrderSubmission(p.OrderID)
+	if err == error_messages.ErrInvalidTransition {
+		log.Printf("handleSubmitOrderJob: Order %d is no longer paid, nothing to submit\n", p.OrderID)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer func() {
+		if err := cart.Repo.ReleaseOrderSubmission(p.OrderID); err != nil {
+			log.Printf("handleSubmitOrderJob: Could not release order %d: %v\n", p.OrderID, err)
+		}
+	}()
+
+	order, err := cart.Repo.GetOrderByID(p.OrderID)
+	if err != nil {
+		return err
+	}
+
+	return submitOrder(order, clientInfoFromOrder(order))
+}
+
+// Queue every order whose submission failed to be submitted again by the job
+// worker as soon as possible, returning how many were queued. Orders are never
+// submitted from here, a job the server is running could be submitting them
+// at the same time.
+func RetryFailedSubmissions() (int, error) {
+	orders, err := cart.Repo.GetOrdersByStatus(cart.OrderSubmissionFailed)
+	if err != nil {
+		return 0, err
+	}
+
+	queued := 0
+	for _, order := range orders {
+		if _, err := jobs.RequeueOnce(submitOrderJob, submitOrderPayload{OrderID: order.ID}); err != nil {
+			log.Printf("RetryFailedSubmissions: Could not requeue order %d: %v\n", order.ID, err)
+			continue
+		}
+		queued++
+	}
+	return queued, nil
+}
@@ -0,0 +1,215 @@
+package external
+
+/* Printify order webhooks: production and shipment updates after submission */
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"server/cart"
+	"server/config"
+	"server/error_messages"
+	"server/notify"
+	"strings"
+	"time"
+)
+
+type printifyEvent struct {
+	ID        string `json:"id"`
+	Type      string `json:"type"`
+	CreatedAt string `json:"created_at"`
+	Resource  struct {
+		ID   string          `json:"id"`
+		Type string          `json:"type"`
+		Data json.RawMessage `json:"data"`
+	} `json:"resource"`
+}
+
+type printifyEventData struct {
+	Status      string `json:"status"`
+	ShippedAt   string `json:"shipped_at"`
+	DeliveredAt string `json:"delivered_at"`
+	Carrier     struct {
+		Code           string `json:"code"`
+		TrackingNumber string `json:"tracking_number"`
+		TrackingURL    string `json:"tracking_url"`
+	} `json:"carrier"`
+}
+
+// Printify's timestamp format, ex: 2022-05-17 11:21:22+00:00
+const printifyTimeLayout = "2006-01-02 15:04:05-07:00"
+
+func handlePrintifyWebhook(w http.ResponseWriter, req *http.Request) {
+	const MaxBodyBytes = int64(65536)
+	req.Body = http.MaxBytesReader(w, req.Body, MaxBodyBytes)
+	payload, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		log.Printf("handlePrintifyWebhook: Error reading request body: %v\n", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	if !validPrintifySignature(payload, req.Header.Get("X-Pfy-Signature")) {
+		log.Printf("Error in handlePrintifyWebhook: Webhook signature verification failed\n")
+		notify.AlertOwner("webhook_signature", "printify", "A Printify webhook failed signature verification")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var event printifyEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		log.Printf("Error in handlePrintifyWebhook: Webhook error while parsing request. %v\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// Unsubmitted orders have an empty Printify order id, and every event
+	// without an id would share one ledger entry
+	if event.ID == "" || event.Resource.ID == "" {
+		log.Printf("Error in handlePrintifyWebhook: %s event is missing its id or resource id\n", event.Type)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// Printify event ids share the ledger with Stripe's
+	event_id := "printify:" + event.ID
+	if !beginWebhookEvent(w, event_id, event.Type) {
+		return
+	}
+
+	status, err := processPrintifyEvent(event)
+	if err := cart.Repo.FinishWebhookEvent(event_id, err); err != nil {
+		log.Printf("Error in handlePrintifyWebhook: Could not record outcome of event %s: %v\n", event_id, err)
+	}
+
+	w.WriteHeader(status)
+}
+
+// Printify signs the body with HMAC-SHA256 using the webhook's secret and
+// sends it as "sha256=<hex digest>".
+func validPrintifySignature(payload []byte, header string) bool {
+	if config.PRINTIFY_WEBHOOK_SECRET == "" {
+		log.Printf("validPrintifySignature: PRINTIFY_WEBHOOK_SECRET is not set\n")
+		return false
+	}
+
+	signature, err := hex.DecodeString(strings.TrimPrefix(header, "sha256="))
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(config.PRINTIFY_WEBHOOK_SECRET))
+	mac.Write(payload)
+	return hmac.Equal(signature, mac.Sum(nil))
+}
+
+// Handle a verified event, returning the status code to respond with
+func processPrintifyEvent(event printifyEvent) (int, error) {
+	if event.Resource.Type != "order" {
+		return http.StatusOK, nil
+	}
+
+	var data printifyEventData
+	if len(event.Resource.Data) > 0 {
+		if err := json.Unmarshal(event.Resource.Data, &data); err != nil {
+			log.Printf("Error parsing Printify webhook data: %v\n", err)
+			return http.StatusBadRequest, err
+		}
+	}
+
+	order, err := cart.Repo.GetOrderByPrintifyOrderID(event.Resource.ID)
+	if err == error_messages.ErrNotExists {
+		// Orders placed on Printify directly aren't ours to track
+		log.Printf("processPrintifyEvent: No order for Printify order %s (%s)\n", event.Resource.ID, event.Type)
+		return http.StatusOK, nil
+	} else if err != nil {
+		log.Printf("processPrintifyEvent: Error retrieving Printify order %s: %v\n", event.Resource.ID, err)
+		return http.StatusInternalServerError, err
+	}
+
+	log.Printf("Printify %s for order %d\n", event.Type, order.ID)
+
+	switch event.Type {
+	case "order:created":
+		cart.Repo.AddOrderEvent(order.ID, "printify_created", event.Resource.ID)
+	case "order:updated":
+		cart.Repo.AddOrderEvent(order.ID, "printify_updated", data.Status)
+		switch data.Status {
+		case "in-production":
+			err = advanceOrder(order, cart.OrderInProduction)
+		case "canceled":
+			// Canceled on Printify's side, the payment has to be refunded by hand
+			log.Printf("processPrintifyEvent: Printify canceled order %d\n", order.ID)
+			err = advanceOrder(order, cart.OrderCanceled)
+		}
+	case "order:sent-to-production":
+		err = advanceOrder(order, cart.OrderInProduction)
+	case "order:shipment:created":
+		shipment := shipmentFromEvent(order, data)
+		shipment.ShippedAt = parsePrintifyTime(data.ShippedAt)
+		if err := cart.Repo.SaveShipment(shipment); err != nil {
+			log.Printf("processPrintifyEvent: Could not store shipment of order %d: %v\n", order.ID, err)
+			return http.StatusInternalServerError, err
+		}
+		cart.Repo.AddOrderEvent(order.ID, "shipment_created", shipment.Carrier+" "+shipment.TrackingNumber)
+		notify.Enqueue(notify.Shipment, order.ID, shipment.TrackingNumber)
+		err = advanceOrder(order, cart.OrderShipped)
+	case "order:shipment:delivered":
+		shipment := shipmentFromEvent(order, data)
+		shipment.DeliveredAt = parsePrintifyTime(data.DeliveredAt)
+		if err := cart.Repo.DeliverShipment(shipment); err != nil {
+			log.Printf("processPrintifyEvent: Could not store delivery of order %d: %v\n", order.ID, err)
+			return http.StatusInternalServerError, err
+		}
+		cart.Repo.AddOrderEvent(order.ID, "shipment_delivered", shipment.Carrier+" "+shipment.TrackingNumber)
+		// The shipment:created event may have been missed
+		if err = advanceOrder(order, cart.OrderShipped); err == nil {
+			err = advanceOrder(order, cart.OrderDelivered)
+		}
+	}
+
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+// Move the order forward to the status Printify reported. Updates that don't
+// fit the order's status, such as ones arriving out of order, are recorded
+// and otherwise ignored.
+func advanceOrder(order *cart.Order, to cart.OrderStatus) error {
+	if order.Status == to {
+		return nil
+	}
+	if !order.Status.CanTransition(to) {
+		log.Printf("advanceOrder: Ignoring %s for order %d, it is %s\n", to, order.ID, order.Status)
+		cart.Repo.AddOrderEvent(order.ID, "printify_ignored", string(order.Status)+" -> "+string(to))
+		return nil
+	}
+	if err := cart.Repo.UpdateOrderStatus(order.ID, to); err != nil {
+		return err
+	}
+	order.Status = to
+	return nil
+}
+
+func shipmentFromEvent(order *cart.Order, data printifyEventData) cart.Shipment {
+	return cart.Shipment{
+		OrderID:        order.ID,
+		Carrier:        data.Carrier.Code,
+		TrackingNumber: data.Carrier.TrackingNumber,
+		TrackingURL:    data.Carrier.TrackingURL,
+	}
+}
+
+func parsePrintifyTime(value string) time.Time {
+	t, err := time.Parse(printifyTimeLayout, value)
+	if err != nil {
+		return time.Now()
+	}
+	return t
+}
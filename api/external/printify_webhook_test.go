@@ -0,0 +1,48 @@
+package external
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"server/config"
+	"strings"
+	"testing"
+)
+
+func TestValidPrintifySignature(t *testing.T) {
+	defer func(secret string) { config.PRINTIFY_WEBHOOK_SECRET = secret }(config.PRINTIFY_WEBHOOK_SECRET)
+
+	payload := []byte(`{"id":"evt_1","type":"order:updated"}`)
+	sign := func(secret string, payload []byte) string {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(payload)
+		return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	valid := sign("secret", payload)
+
+	tests := []struct {
+		name    string
+		secret  string
+		payload []byte
+		header  string
+		want    bool
+	}{
+		{"valid", "secret", payload, valid, true},
+		{"upper case hex", "secret", payload, "sha256=" + strings.ToUpper(strings.TrimPrefix(valid, "sha256=")), true},
+		{"no secret set", "", payload, sign("", payload), false},
+		{"wrong secret", "other", payload, valid, false},
+		{"changed payload", "secret", []byte(`{"id":"evt_2","type":"order:updated"}`), valid, false},
+		{"not hex", "secret", payload, "sha256=not-a-signature", false},
+		{"truncated", "secret", payload, valid[:len(valid)-2], false},
+		{"empty", "secret", payload, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.PRINTIFY_WEBHOOK_SECRET = tt.secret
+			if got := validPrintifySignature(tt.payload, tt.header); got != tt.want {
+				t.Errorf("validPrintifySignature() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
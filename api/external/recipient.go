@@ -0,0 +1,79 @@
+package external
+
+/* Recipient name and phone number of Printify orders */
+
+import "strings"
+
+// Words that start a family name, ex: "van Dyke", "de la Cruz"
+var surnameParticles = map[string]bool{
+	"al": true, "bin": true, "da": true, "das": true, "de": true, "del": true, "della": true,
+	"der": true, "di": true, "dos": true, "du": true, "el": true, "la": true, "le": true,
+	"st.": true, "ten": true, "ter": true, "van": true, "von": true,
+}
+
+// Kept with the family name, ex: "Smith Jr."
+var nameSuffixes = map[string]bool{
+	"jr": true, "jr.": true, "sr": true, "sr.": true, "ii": true, "iii": true, "iv": true,
+}
+
+// Split a full name into the first and last name of a Printify address. Every
+// word is kept: the last name is the final word along with any particles before
+// it and suffixes after it, the first name is the rest. A single word is used
+// as the first name.
+func splitName(name string) (string, string) {
+	words := strings.Fields(name)
+	switch len(words) {
+	case 0:
+		return "", ""
+	case 1:
+		return words[0], ""
+	}
+
+	last := len(words) - 1
+	for last > 1 && nameSuffixes[strings.ToLower(words[last])] {
+		last--
+	}
+	for last > 1 && surnameParticles[strings.ToLower(words[last-1])] {
+		last--
+	}
+
+	return strings.Join(words[:last], " "), strings.Join(words[last:], " ")
+}
+
+// Phone numbers have at most 15 digits with the country code (E.164), and
+// fewer than 7 can't be dialed anywhere
+const (
+	minPhoneDigits = 7
+	maxPhoneDigits = 15
+)
+
+// Strip the spaces, dashes, dots and parentheses people format phone numbers
+// with, keeping a leading + and its country code, ex: "+44 20 7946 0958"
+// becomes "+442079460958". Returns false if it isn't a phone number.
+func normalizePhone(phone string) (string, bool) {
+	phone = strings.TrimSpace(phone)
+	if strings.HasPrefix(phone, "00") {
+		// International dialing prefix used in most of the world
+		phone = "+" + phone[2:]
+	}
+
+	var b strings.Builder
+	digits := 0
+	for i, r := range phone {
+		switch {
+		case r >= '0' && r <= '9':
+			b.WriteRune(r)
+			digits++
+		case r == '+' && i == 0:
+			b.WriteRune(r)
+		case r == ' ' || r == '-' || r == '.' || r == '(' || r == ')':
+		default:
+			return "", false
+		}
+	}
+
+	if digits < minPhoneDigits || digits > maxPhoneDigits {
+		return "", false
+	}
+	return b.String(), true
+}
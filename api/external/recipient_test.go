@@ -0,0 +1,60 @@
+package external
+
+import "testing"
+
+func TestSplitName(t *testing.T) {
+	tests := []struct {
+		name  string
+		first string
+		last  string
+	}{
+		{"Mary Smith", "Mary", "Smith"},
+		{"Mary Ann van Dyke", "Mary Ann", "van Dyke"},
+		{"Juan de la Cruz", "Juan", "de la Cruz"},
+		{"Martin Luther King Jr.", "Martin Luther", "King Jr."},
+		{"John Smith III", "John", "Smith III"},
+		{"  Mary   Smith ", "Mary", "Smith"},
+		{"Van Morrison", "Van", "Morrison"},
+		{"Jr. Smith", "Jr.", "Smith"},
+		{"Cher", "Cher", ""},
+		{"", "", ""},
+		{"   ", "", ""},
+	}
+
+	for _, tt := range tests {
+		first, last := splitName(tt.name)
+		if first != tt.first || last != tt.last {
+			t.Errorf("splitName(%q) = %q, %q, want %q, %q", tt.name, first, last, tt.first, tt.last)
+		}
+	}
+}
+
+func TestNormalizePhone(t *testing.T) {
+	tests := []struct {
+		phone string
+		want  string
+		ok    bool
+	}{
+		{"2175550123", "2175550123", true},
+		{"(217) 555-0123", "2175550123", true},
+		{"217.555.0123", "2175550123", true},
+		{"+44 20 7946 0958", "+442079460958", true},
+		{"0044 20 7946 0958", "+442079460958", true},
+		{" +1 217 555 0123 ", "+12175550123", true},
+		{"555-0123", "5550123", true},
+		{"555-012", "", false},
+		{"+1234567890123456", "", false},
+		{"217-555-CALL", "", false},
+		{"217 555 0123 ext 4", "", false},
+		{"1+2175550123", "", false},
+		{"++12175550123", "", false},
+		{"", "", false},
+	}
+
+	for _, tt := range tests {
+		got, ok := normalizePhone(tt.phone)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("normalizePhone(%q) = %q, %v, want %q, %v", tt.phone, got, ok, tt.want, tt.ok)
+		}
+	}
+}
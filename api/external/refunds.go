@@ -0,0 +1,197 @@
+package external
+
+/* Refunds, cancellations and disputes reported by Stripe */
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"server/cart"
+	"server/error_messages"
+	"server/notify"
+	"strconv"
+
+	"github.com/stripe/stripe-go/v74"
+	"github.com/stripe/stripe-go/v74/charge"
+)
+
+// Record a refund of the charge on its order. A full refund also stops the
+// order from being fulfilled if it isn't in production yet, the owner is
+// alerted if it can't be stopped.
+func handleChargeRefunded(ch stripe.Charge) error {
+	if ch.PaymentIntent == nil {
+		log.Printf("handleChargeRefunded: Charge %s has no PaymentIntent\n", ch.ID)
+		return nil
+	}
+
+	order, err := cart.Repo.GetOrderByPaymentIntentID(ch.PaymentIntent.ID)
+	if err == error_messages.ErrNotExists {
+		log.Printf("handleChargeRefunded: No order for %s\n", ch.PaymentIntent.ID)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if err := cart.Repo.UpdateOrderRefunded(order.ID, ch.AmountRefunded); err != nil {
+		return err
+	}
+	cart.Repo.AddOrderEvent(order.ID, "refund", fmt.Sprintf("charge %s refunded %d of %d", ch.ID, ch.AmountRefunded, ch.Amount))
+	log.Printf("handleChargeRefunded: Order %d refunded %d of %d\n", order.ID, ch.AmountRefunded, ch.Amount)
+	notify.Enqueue(notify.Refund, order.ID, strconv.FormatInt(ch.AmountRefunded, 10))
+
+	if !ch.Refunded {
+		// Partial refunds are for the owner to settle, the order still ships
+		return nil
+	}
+
+	if !stopFulfillment(order) {
+		alertNotStopped(order, "was fully refunded")
+		return nil
+	}
+	// The refund can arrive before the payment it refunds was handled, an
+	// order that was never paid is canceled instead
+	if !order.Status.CanTransition(cart.OrderRefunded) {
+		return moveOrder(order, cart.OrderCanceled)
+	}
+	return moveOrder(order, cart.OrderRefunded)
+}
+
+// A canceled PaymentIntent was never paid, so there is nothing to fulfill
+func handlePaymentIntentCanceled(payment_intent stripe.PaymentIntent) {
+	reopenCart(payment_intent.ID, true)
+
+	order, err := cart.Repo.GetOrderByPaymentIntentID(payment_intent.ID)
+	if err != nil {
+		return
+	}
+	cart.Repo.AddOrderEvent(order.ID, "payment_canceled", string(payment_intent.CancellationReason))
+}
+
+// The customer disputed the payment. Hold off on fulfilling the order while
+// it can still be stopped.
+func handleDisputeCreated(dispute stripe.Dispute) error {
+	order, err := disputedOrder(dispute)
+	if err != nil || order == nil {
+		return err
+	}
+
+	if err := cart.Repo.UpdateOrderDisputeStatus(order.ID, string(dispute.Status)); err != nil {
+		return err
+	}
+	cart.Repo.AddOrderEvent(order.ID, "dispute_created", fmt.Sprintf("dispute %s for %d: %s", dispute.ID, dispute.Amount, dispute.Reason))
+	log.Printf("handleDisputeCreated: Order %d disputed (%s): %s\n", order.ID, dispute.ID, dispute.Reason)
+
+	if !stopFulfillment(order) {
+		return nil
+	}
+	return moveOrder(order, cart.OrderCanceled)
+}
+
+// Record how a dispute ended. A lost dispute takes the money back, the same as
+// a refund.
+func handleDisputeClosed(dispute stripe.Dispute) error {
+	order, err := disputedOrder(dispute)
+	if err != nil || order == nil {
+		return err
+	}
+
+	if err := cart.Repo.UpdateOrderDisputeStatus(order.ID, string(dispute.Status)); err != nil {
+		return err
+	}
+	cart.Repo.AddOrderEvent(order.ID, "dispute_closed", fmt.Sprintf("dispute %s %s", dispute.ID, dispute.Status))
+	log.Printf("handleDisputeClosed: Dispute %s on order %d closed as %s\n", dispute.ID, order.ID, dispute.Status)
+
+	if dispute.Status != stripe.DisputeStatusLost {
+		return nil
+	}
+
+	if !stopFulfillment(order) {
+		alertNotStopped(order, "lost its dispute")
+		return nil
+	}
+	if order.Status.CanTransition(cart.OrderRefunded) {
+		return moveOrder(order, cart.OrderRefunded)
+	}
+	return nil
+}
+
+// Find the order of a disputed payment. Returns a nil order if there is none.
+func disputedOrder(dispute stripe.Dispute) (*cart.Order, error) {
+	payment_intent_id := ""
+	if dispute.PaymentIntent != nil {
+		payment_intent_id = dispute.PaymentIntent.ID
+	} else if dispute.Charge != nil {
+		// Older disputes only reference the charge
+		ch, err := charge.Get(dispute.Charge.ID, nil)
+		if err != nil {
+			log.Printf("disputedOrder: Could not retrieve charge %s: %v\n", dispute.Charge.ID, err)
+			return nil, err
+		}
+		if ch.PaymentIntent != nil {
+			payment_intent_id = ch.PaymentIntent.ID
+		}
+	}
+
+	if payment_intent_id == "" {
+		log.Printf("disputedOrder: Dispute %s has no PaymentIntent\n", dispute.ID)
+		return nil, nil
+	}
+
+	order, err := cart.Repo.GetOrderByPaymentIntentID(payment_intent_id)
+	if err == error_messages.ErrNotExists {
+		log.Printf("disputedOrder: No order for %s\n", payment_intent_id)
+		return nil, nil
+	}
+	return order, err
+}
+
+// Keep an order from being made. Orders that haven't reached Printify are
+// stopped by moving them out of paid, orders that have are canceled on
+// Printify. A submission that is being sent cancels its Printify order once it
+// sees the order moved. Canceled and refunded orders are already stopped.
+// Returns false if the order is already in production or past it.
+func stopFulfillment(order *cart.Order) bool {
+	switch order.Status {
+	case cart.OrderPendingPayment, cart.OrderNeedsReview, cart.OrderCanceled, cart.OrderRefunded:
+		return true
+	case cart.OrderPaid, cart.OrderSubmissionFailed, cart.OrderSubmitted:
+		if order.PrintifyOrderID == "" {
+			return true
+		}
+		if err := cancelPrintifyOrder(order.PrintifyOrderID); err != nil {
+			log.Printf("stopFulfillment: COULD NOT CANCEL Printify order %s of order %d: %v\n", order.PrintifyOrderID, order.ID, err)
+			cart.Repo.AddOrderEvent(order.ID, "printify_cancel_failed", err.Error())
+			return false
+		}
+		cart.Repo.AddOrderEvent(order.ID, "printify_canceled", order.PrintifyOrderID)
+		return true
+	case cart.OrderInProduction, cart.OrderShipped, cart.OrderDelivered:
+		log.Printf("stopFulfillment: Order %d is already %s, it can't be canceled on Printify\n", order.ID, order.Status)
+		cart.Repo.AddOrderEvent(order.ID, "printify_not_canceled", "order is "+string(order.Status))
+	}
+	return false
+}
+
+// The money of an order that is still being made is gone. Its status is left
+// alone, it is for the owner to decide what happens to it.
+func alertNotStopped(order *cart.Order, what string) {
+	notify.AlertOwner("fulfillment_not_stopped", fmt.Sprint(order.ID),
+		fmt.Sprintf("Order %d %s but is %s and could not be canceled on Printify, it will still ship", order.ID, what, order.Status))
+}
+
+// Printify only cancels orders that haven't been sent to production
+func cancelPrintifyOrder(printify_order_id string) error {
+	return printifyRequest(http.MethodPost, fmt.Sprintf("shops/%d/orders/%s/cancel.json", shop_id, printify_order_id), nil, nil)
+}
+
+// Move the order to a final status unless it is already final
+func moveOrder(order *cart.Order, to cart.OrderStatus) error {
+	if order.Status == to || order.Status == cart.OrderCanceled || order.Status == cart.OrderRefunded {
+		return nil
+	}
+	if err := cart.Repo.UpdateOrderStatus(order.ID, to); err != nil {
+		return err
+	}
+	order.Status = to
+	return nil
+}
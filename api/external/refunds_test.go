@@ -0,0 +1,149 @@
+package external
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"server/cart"
+	"testing"
+	"time"
+
+	"github.com/stripe/stripe-go/v74"
+)
+
+// Point cart.Repo at an empty database for the length of the test
+func useTestDatabase(t *testing.T) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	previous := cart.Repo
+	cart.Repo = cart.NewSQLiteDatabase(db)
+	t.Cleanup(func() { cart.Repo = previous })
+
+	if err := cart.Repo.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Create an order for the PaymentIntent and move it through statuses
+func createTestOrder(t *testing.T, payment_intent_id string, statuses ...cart.OrderStatus) *cart.Order {
+	t.Helper()
+	shopping_cart, err := cart.Repo.CreateCartEntry("session_" + payment_intent_id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	order, err := cart.Repo.SaveOrderSnapshot(&cart.Order{ShoppingCartID: shopping_cart.ID, PaymentIntentID: payment_intent_id, Subtotal: 2000, Total: 2000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range statuses {
+		if err := cart.Repo.UpdateOrderStatus(order.ID, status); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return order
+}
+
+// Whether the owner was alerted that the order will ship anyway
+func alertedNotStopped(t *testing.T, order_id int64) bool {
+	t.Helper()
+	send, _, err := cart.Repo.RecordAlert(fmt.Sprintf("fulfillment_not_stopped:%d", order_id), time.Now(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return !send
+}
+
+func fullRefund(payment_intent_id string) error {
+	return handleChargeRefunded(stripe.Charge{ID: "ch_" + payment_intent_id, PaymentIntent: &stripe.PaymentIntent{ID: payment_intent_id}, Amount: 2000, AmountRefunded: 2000, Refunded: true})
+}
+
+func TestStopRefundedAndDisputedOrders(t *testing.T) {
+	useTestDatabase(t)
+
+	tests := []struct {
+		name     string
+		statuses []cart.OrderStatus
+		event    func(payment_intent_id string) error
+		want     cart.OrderStatus
+	}{
+		{
+			name:     "refund of a canceled order",
+			statuses: []cart.OrderStatus{cart.OrderPaid, cart.OrderCanceled},
+			event: func(payment_intent_id string) error {
+				return fullRefund(payment_intent_id)
+			},
+			want: cart.OrderCanceled,
+		},
+		{
+			name:     "refund of a refunded order",
+			statuses: []cart.OrderStatus{cart.OrderPaid, cart.OrderRefunded},
+			event: func(payment_intent_id string) error {
+				return fullRefund(payment_intent_id)
+			},
+			want: cart.OrderRefunded,
+		},
+		{
+			name: "refund before the payment was handled",
+			event: func(payment_intent_id string) error {
+				return fullRefund(payment_intent_id)
+			},
+			want: cart.OrderCanceled,
+		},
+		{
+			name:     "refund of a paid order",
+			statuses: []cart.OrderStatus{cart.OrderPaid},
+			event: func(payment_intent_id string) error {
+				return fullRefund(payment_intent_id)
+			},
+			want: cart.OrderRefunded,
+		},
+		{
+			name:     "lost dispute of an order canceled when it was disputed",
+			statuses: []cart.OrderStatus{cart.OrderPaid},
+			event: func(payment_intent_id string) error {
+				dispute := stripe.Dispute{ID: "dp_" + payment_intent_id, PaymentIntent: &stripe.PaymentIntent{ID: payment_intent_id}, Amount: 2000, Status: stripe.DisputeStatusNeedsResponse}
+				if err := handleDisputeCreated(dispute); err != nil {
+					return err
+				}
+				dispute.Status = stripe.DisputeStatusLost
+				return handleDisputeClosed(dispute)
+			},
+			want: cart.OrderCanceled,
+		},
+		{
+			name:     "lost dispute of a refunded order",
+			statuses: []cart.OrderStatus{cart.OrderPaid, cart.OrderRefunded},
+			event: func(payment_intent_id string) error {
+				return handleDisputeClosed(stripe.Dispute{ID: "dp_" + payment_intent_id, PaymentIntent: &stripe.PaymentIntent{ID: payment_intent_id}, Amount: 2000, Status: stripe.DisputeStatusLost})
+			},
+			want: cart.OrderRefunded,
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payment_intent_id := fmt.Sprintf("pi_%d", i)
+			order := createTestOrder(t, payment_intent_id, tt.statuses...)
+
+			if err := tt.event(payment_intent_id); err != nil {
+				t.Fatalf("event failed: %v", err)
+			}
+
+			order, err := cart.Repo.GetOrderByID(order.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if order.Status != tt.want {
+				t.Errorf("status = %s, want %s", order.Status, tt.want)
+			}
+			if alertedNotStopped(t, order.ID) {
+				t.Errorf("owner was alerted that order %d could not be stopped", order.ID)
+			}
+		})
+	}
+}
@@ -9,11 +9,13 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"server/cart"
 	"server/config"
 	"server/session"
+	"server/shipping"
+	"server/tax"
 	"strings"
 
-	"github.com/gorilla/csrf"
 	"github.com/stripe/stripe-go/v74"
 	"github.com/stripe/stripe-go/v74/paymentintent"
 )
@@ -25,10 +27,31 @@ const (
 )
 
 type UpdateData struct {
-	Status        string `json:"status"`
-	ItemsPrice    string `json:"cart"`
-	ShippingPrice string `json:"shipping"`
-	TotalPrice    string `json:"total"`
+	Status        string      `json:"status"`
+	Items         []ItemPrice `json:"items"`
+	ItemsPrice    string      `json:"cart"`
+	ShippingPrice string      `json:"shipping"`
+	Discount      string      `json:"discount"`
+	PromoCode     string      `json:"promo_code,omitempty"`
+	PromoError    string      `json:"promo_error,omitempty"` // Why the cart's promo code was removed
+	Tax           string      `json:"tax"`
+	TotalPrice    string      `json:"total"`
+
+	// The method ShippingPrice is for and every method the customer can choose
+	ShippingMethod  string           `json:"shipping_method"`
+	ShippingOptions []ShippingOption `json:"shipping_options"`
+	// Whether the shipping options were quoted live, cached or fallback
+	ShippingQuote shipping.Source `json:"shipping_quote"`
+}
+
+// Price of a single cart item in the UpdateData breakdown
+type ItemPrice struct {
+	Item      string `json:"id"`
+	Size      string `json:"size"`
+	Color     string `json:"color"`
+	Quantity  int64  `json:"quantity"`
+	UnitPrice string `json:"unit_price"`
+	Price     string `json:"price"`
 }
 
 type ClientInfo struct {
@@ -37,6 +60,9 @@ type ClientInfo struct {
 	Name            string   `json:"name"`
 	Address         *Address `json:"address"`
 	Email           string   `json:"receipt_email,omitempty"`
+	Phone           string   `json:"phone,omitempty"`
+	// One of the methods in UpdateData.ShippingOptions, standard if empty
+	ShippingMethod string `json:"shipping_method,omitempty"`
 }
 
 type Address struct {
@@ -52,7 +78,11 @@ func InitHandlers(mux *http.ServeMux) {
 	// This is your test secret API key.
 	stripe.Key = config.STRIPE_SECRET
 
-	mux.HandleFunc("/api/create-payment-intent", handleCreatePaymentIntent)
+	mux.HandleFunc("/api/checkout", handleCheckout)
+	mux.HandleFunc("/api/checkout/cancel", handleCheckoutCancel)
+	// Older frontends create the PaymentIntent here, checkout returns the
+	// same clientSecret field.
+	mux.HandleFunc("/api/create-payment-intent", handleCheckout)
 	mux.HandleFunc("/api/address-update", handleUpdate)
 }
 
@@ -74,11 +104,23 @@ func handleUpdate(w http.ResponseWriter, r *http.Request) {
 	}
 
 	update.PaymentIntentID = strings.Split(update.ClientSecret, "_secret")[0]
+	if update.PaymentIntentID == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		log.Printf("handleUpdate: Request has no client_secret\n")
+		return
+	}
 
-	amount, err := session.RetrieveOrderAmountAndItems(update.PaymentIntentID)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Printf("handleUpdate: Error in RetrieveOrderAmountAndItems(): %v\n", err)
+	// Unsupported destinations are caught here instead of by Printify after
+	// the customer has paid.
+	if errs := validateAddress(&update); len(errs) > 0 {
+		log.Printf("handleUpdate: Invalid address for %s: %v\n", update.PaymentIntentID, errs)
+		writeJSON(w, http.StatusUnprocessableEntity, struct {
+			Status string         `json:"status"`
+			Errors []AddressError `json:"errors"`
+		}{
+			Status: "invalid_address",
+			Errors: errs,
+		})
 		return
 	}
 
@@ -89,101 +131,129 @@ func handleUpdate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	shipping_cost := GetShippingCost(cart_items, &update)
-
-	cart_total := amount
-
-	amount += shipping_cost
-
-	log.Printf("Updating cost for %s: cart=%d, shipping=%d, total=%d\n", update.PaymentIntentID, cart_total, shipping_cost, amount)
-
-	pi, err := updatePaymentIntentAmount(update.PaymentIntentID, amount)
-
+	item_prices, err := formItemPrices(cart_items)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Printf("handleUpdate: error from updatePaymentIntentAmount: %v\n", err)
+		log.Printf("handleUpdate: Error in formItemPrices(): %v\n", err)
 		return
 	}
 
-	data := UpdateData{
-		Status:        string(pi.Status),
-		ItemsPrice:    fmt.Sprintf("%.2f", float64(cart_total)/100),
-		ShippingPrice: fmt.Sprintf("%.2f", float64(shipping_cost)/100),
-		TotalPrice:    fmt.Sprintf("%.2f", float64(amount)/100),
+	shipping_options, shipping_quote := GetShippingOptions(cart_items, &update)
+	chosen_shipping := selectShippingOption(shipping_options, update.ShippingMethod)
+
+	// The email is known now, so codes limited to one use per customer are
+	// checked again. Codes that no longer apply are removed from the cart.
+	promo_code := ""
+	shopping_cart, err := cart.Repo.GetCartByPaymentIntentID(update.PaymentIntentID)
+	if err != nil || shopping_cart.PaymentIntentID != update.PaymentIntentID {
+		// Never touch the promo code of a cart that isn't this PaymentIntent's
+		shopping_cart = nil
+	} else {
+		promo_code = shopping_cart.PromoCode
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(data)
-}
 
-func handleCreatePaymentIntent(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	promo_error := ""
+	amounts, err := cart.CartAmounts(cart_items, chosen_shipping.Cost, promo_code, update.Email)
+	if cart.IsPromoError(err) {
+		promo_error = err.Error()
+		if shopping_cart != nil {
+			log.Printf("handleUpdate: Removing promo code %s from cart %d: %v\n", promo_code, shopping_cart.ID, err)
+			if err := cart.Repo.UpdateCartPromoCode(shopping_cart.ID, ""); err != nil {
+				log.Printf("handleUpdate: Could not remove promo code: %v\n", err)
+			}
+		}
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("handleUpdate: Error in CartAmounts(): %v\n", err)
 		return
 	}
+	amounts.ShippingMethod = chosen_shipping.Method
+
+	addTax(amounts, cart_items, update.Address)
+
+	log.Printf("Updating cost for %s: cart=%d, shipping=%d (%s, %s), discount=%d, tax=%d, total=%d\n", update.PaymentIntentID, amounts.Subtotal, amounts.Shipping, amounts.ShippingMethod, shipping_quote, amounts.Discount, amounts.Tax, amounts.Total)
+
+	pi, err := updatePaymentIntentAmount(update.PaymentIntentID, amounts.Total)
 
-	session_id := session.BeginSession(w, r)
-	order_amount, err := session.RetrieveOrderAmount(w, session_id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Printf("Error retrieving order amount for session id: %s\n", session_id)
+		log.Printf("handleUpdate: error from updatePaymentIntentAmount: %v\n", err)
 		return
 	}
 
-	// Check for an existing PaymentIntent ID for the user
-	paymentintent_id, err := session.RetrievePaymentIntentID(session_id)
-	if err != nil {
+	// Fallback rates are only an estimate, orders paid with them are reviewed
+	if _, err := saveOrderSnapshot(update.PaymentIntentID, cart_items, amounts, shipping_quote != shipping.Fallback); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Printf("Error retrieving PaymentIntent for session id: %s\n", session_id)
+		log.Printf("handleUpdate: Error saving order snapshot: %v\n", err)
 		return
 	}
 
-	// Create a PaymentIntent with amount and currency
-	params := &stripe.PaymentIntentParams{
-		Amount:   stripe.Int64(order_amount),
-		Currency: stripe.String(string(stripe.CurrencyUSD)),
-		AutomaticPaymentMethods: &stripe.PaymentIntentAutomaticPaymentMethodsParams{
-			Enabled: stripe.Bool(true),
-		},
+	data := UpdateData{
+		Status:          string(pi.Status),
+		Items:           item_prices,
+		ItemsPrice:      fmt.Sprintf("%.2f", float64(amounts.Subtotal)/100),
+		ShippingPrice:   fmt.Sprintf("%.2f", float64(amounts.Shipping)/100),
+		ShippingMethod:  amounts.ShippingMethod,
+		ShippingOptions: shipping_options,
+		ShippingQuote:   shipping_quote,
+		Discount:        fmt.Sprintf("%.2f", float64(amounts.Discount)/100),
+		PromoCode:       amounts.PromoCode,
+		PromoError:      promo_error,
+		Tax:             fmt.Sprintf("%.2f", float64(amounts.Tax)/100),
+		TotalPrice:      fmt.Sprintf("%.2f", float64(amounts.Total)/100),
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(data)
+}
 
-	var payment_intent_exists bool = (paymentintent_id != "")
-
-	var pi *stripe.PaymentIntent
-	if payment_intent_exists {
-		pi, err = updatePaymentIntentAmount(paymentintent_id, order_amount)
-		log.Printf("pi Exists: %v", pi.ClientSecret)
-	} else {
-		pi, err = paymentintent.New(params)
-		log.Printf("pi.New: %v", pi.ClientSecret)
+// Price each cart item for the UpdateData and checkout breakdowns
+func formItemPrices(items []cart.CartItem) ([]ItemPrice, error) {
+	item_prices := []ItemPrice{}
+	for _, item := range cart.AggregateItems(items) {
+		price, err := item.Price()
+		if err != nil {
+			return nil, err
+		}
+		item_prices = append(item_prices, ItemPrice{
+			Item:      item.Item,
+			Size:      item.Size,
+			Color:     item.Color,
+			Quantity:  item.Quantity,
+			UnitPrice: fmt.Sprintf("%.2f", float64(price)/100),
+			Price:     fmt.Sprintf("%.2f", float64(price*item.Quantity)/100),
+		})
 	}
+	return item_prices, nil
+}
 
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Printf("pi error: %v", err)
+// Add the sales tax for the shipping address to the amounts
+func addTax(amounts *cart.Amounts, items []cart.CartItem, address *Address) {
+	if address == nil {
 		return
 	}
 
-	// Store pi ID if it is a new payment intent.
-	if !payment_intent_exists {
-		//log.Printf("\nAdding payment intent to shopping cart, PI ID: %s\n", pi.ID)
-		err = session.AddPaymentIntentID(session_id, pi.ID)
-
+	sale := tax.Sale{
+		Country:    address.Country,
+		State:      address.State,
+		PostalCode: address.PostalCode,
+		Shipping:   amounts.Shipping - amounts.ShippingDiscount,
+	}
+	discounts, err := amounts.LineDiscounts(items)
+	if err != nil {
+		log.Printf("addTax: Could not spread the discount over the items: %v\n", err)
+		discounts = make([]int64, len(items))
+	}
+	for i, item := range items {
+		price, err := item.Price()
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			log.Printf("session.AddPaymentIntentID: %v", err)
-			return
+			continue
 		}
+		sale.Lines = append(sale.Lines, tax.Line{Item: item.Item, Amount: price * item.Quantity, Discount: discounts[i]})
 	}
 
-	log.Printf("SessionID %s, PaymentIntent %s cart total (without shipping): %d\n", session_id, pi.ID, order_amount)
-
-	w.Header().Set("X-CSRF-Token", csrf.Token(r))
-	writeJSON(w, struct {
-		ClientSecret string `json:"clientSecret"`
-	}{
-		ClientSecret: pi.ClientSecret,
-	})
+	amounts.Tax = tax.Rates.Calculate(sale)
+	amounts.Total += amounts.Tax
 }
 
 func updatePaymentIntentAmount(paymentintent_id string, amount int64) (*stripe.PaymentIntent, error) {
@@ -199,7 +269,9 @@ func updatePaymentIntentAmount(paymentintent_id string, amount int64) (*stripe.P
 	return pi, err
 }
 
-func writeJSON(w http.ResponseWriter, v interface{}) {
+// Respond with v as JSON. The status is written after the Content-Type
+// header, which can't be set once the status is out.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
 	var buf bytes.Buffer
 	if err := json.NewEncoder(&buf).Encode(v); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -207,6 +279,7 @@ func writeJSON(w http.ResponseWriter, v interface{}) {
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 	if _, err := io.Copy(w, &buf); err != nil {
 		log.Printf("io.Copy: %v", err)
 		return
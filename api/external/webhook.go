@@ -2,11 +2,14 @@ package external
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"server/cart"
 	"server/config"
+	"server/error_messages"
+	"server/notify"
 	"server/session"
 
 	"github.com/stripe/stripe-go/v74"
@@ -18,6 +21,7 @@ func InitWebhook(mux *http.ServeMux) {
 	stripe.Key = config.STRIPE_SECRET
 
 	mux.HandleFunc("/webhook", handleWebhook)
+	mux.HandleFunc("/printify/webhook", handlePrintifyWebhook)
 }
 
 func handleWebhook(w http.ResponseWriter, req *http.Request) {
@@ -47,9 +51,48 @@ func handleWebhook(w http.ResponseWriter, req *http.Request) {
 	event, err = webhook.ConstructEvent(payload, signatureHeader, endpointSecret)
 	if err != nil {
 		log.Printf("Error in handleWebhook: Webhook signature verification failed. %v\n", err)
+		notify.AlertOwner("webhook_signature", "stripe", fmt.Sprintf("A Stripe webhook failed signature verification: %v", err))
 		w.WriteHeader(http.StatusBadRequest) // Return a 400 error on a bad signature
 		return
 	}
+
+	if !beginWebhookEvent(w, event.ID, string(event.Type)) {
+		return
+	}
+
+	status, err := processEvent(event)
+	if err := cart.Repo.FinishWebhookEvent(event.ID, err); err != nil {
+		log.Printf("Error in handleWebhook: Could not record outcome of event %s: %v\n", event.ID, err)
+	}
+
+	w.WriteHeader(status)
+}
+
+// Record that a verified event is being processed. Stripe and Printify both
+// deliver events at least once, so skip events we've already handled and have
+// the sender come back later if one is still in progress. Returns false if the
+// response was already written.
+func beginWebhookEvent(w http.ResponseWriter, event_id string, event_type string) bool {
+	err := cart.Repo.BeginWebhookEvent(event_id, event_type)
+	switch err {
+	case nil:
+		return true
+	case error_messages.ErrDuplicate:
+		log.Printf("handleWebhook: Event %s (%s) was already processed\n", event_id, event_type)
+		w.WriteHeader(http.StatusOK)
+	case error_messages.ErrInProgress:
+		log.Printf("handleWebhook: Event %s (%s) is already being processed\n", event_id, event_type)
+		w.WriteHeader(http.StatusConflict)
+	default:
+		log.Printf("Error in handleWebhook: Could not record event %s: %v\n", event_id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	return false
+}
+
+// Handle a verified event, returning the status code to respond with. Any
+// status other than 200 makes Stripe retry the event.
+func processEvent(event stripe.Event) (int, error) {
 	// Unmarshal the event data into an appropriate struct depending on its Type
 	switch event.Type {
 	case "payment_intent.succeeded":
@@ -57,23 +100,24 @@ func handleWebhook(w http.ResponseWriter, req *http.Request) {
 		err := json.Unmarshal(event.Data.Raw, &paymentIntent)
 		if err != nil {
 			log.Printf("Error parsing webhook JSON: %v\n", err)
-			w.WriteHeader(http.StatusBadRequest)
-			return
+			return http.StatusBadRequest, err
 		}
 		log.Printf("Successful payment amount for %s: %d.\n", paymentIntent.ID, paymentIntent.Amount)
 		// Inform user their order will be on the way.
 		err = handlePaymentIntentSucceeded(paymentIntent)
 		if err != nil {
+			// Have Stripe retry the event
 			log.Printf("Error in handlePaymentIntentSucceeded: %v\n", err)
-			return
+			notify.AlertOwner("payment_unfulfilled", paymentIntent.ID,
+				fmt.Sprintf("Payment %s for %d succeeded but the order could not be processed, Stripe will retry: %v", paymentIntent.ID, paymentIntent.Amount, err))
+			return http.StatusInternalServerError, err
 		}
 	case "payment_intent.failed":
 		var paymentIntent stripe.PaymentIntent
 		err := json.Unmarshal(event.Data.Raw, &paymentIntent)
 		if err != nil {
 			log.Printf("Error parsing webhook JSON: %v\n", err)
-			w.WriteHeader(http.StatusBadRequest)
-			return
+			return http.StatusBadRequest, err
 		}
 		log.Printf("Failed payment for %s: %d.\n", paymentIntent.ID, paymentIntent.Amount)
 	case "payment_intent.payment_failed":
@@ -81,59 +125,174 @@ func handleWebhook(w http.ResponseWriter, req *http.Request) {
 		err := json.Unmarshal(event.Data.Raw, &paymentIntent)
 		if err != nil {
 			log.Printf("Error parsing webhook JSON: %v\n", err)
-			w.WriteHeader(http.StatusBadRequest)
-			return
+			return http.StatusBadRequest, err
 		}
 		log.Printf("Failed payment for %s: %d.\n", paymentIntent.ID, paymentIntent.Amount)
+		// Let the customer change their cart, they can still retry the
+		// payment with the same PaymentIntent.
+		reopenCart(paymentIntent.ID, false)
+	case "payment_intent.canceled":
+		var paymentIntent stripe.PaymentIntent
+		err := json.Unmarshal(event.Data.Raw, &paymentIntent)
+		if err != nil {
+			log.Printf("Error parsing webhook JSON: %v\n", err)
+			return http.StatusBadRequest, err
+		}
+		log.Printf("Canceled payment for %s: %d.\n", paymentIntent.ID, paymentIntent.Amount)
+		handlePaymentIntentCanceled(paymentIntent)
+	case "charge.refunded":
+		var charge stripe.Charge
+		err := json.Unmarshal(event.Data.Raw, &charge)
+		if err != nil {
+			log.Printf("Error parsing webhook JSON: %v\n", err)
+			return http.StatusBadRequest, err
+		}
+		log.Printf("Refunded %d of charge %s.\n", charge.AmountRefunded, charge.ID)
+		if err := handleChargeRefunded(charge); err != nil {
+			log.Printf("Error in handleChargeRefunded: %v\n", err)
+			return http.StatusInternalServerError, err
+		}
+	case "charge.dispute.created", "charge.dispute.closed":
+		var dispute stripe.Dispute
+		err := json.Unmarshal(event.Data.Raw, &dispute)
+		if err != nil {
+			log.Printf("Error parsing webhook JSON: %v\n", err)
+			return http.StatusBadRequest, err
+		}
+		log.Printf("Dispute %s is %s.\n", dispute.ID, dispute.Status)
+		if event.Type == "charge.dispute.created" {
+			err = handleDisputeCreated(dispute)
+		} else {
+			err = handleDisputeClosed(dispute)
+		}
+		if err != nil {
+			log.Printf("Error handling dispute %s: %v\n", dispute.ID, err)
+			return http.StatusInternalServerError, err
+		}
 	}
 
-	w.WriteHeader(http.StatusOK)
+	return http.StatusOK, nil
 }
 
 func handlePaymentIntentSucceeded(payment_intent stripe.PaymentIntent) error {
-	items, err := session.RetrievePaymentIntentItems(payment_intent.ID)
+	order, err := retrievePaymentIntentOrder(payment_intent.ID)
 
 	if err != nil {
-		log.Printf("handlePaymentIntentSucceeded: Error retrieving client items after succesful payment: %v\n", err)
+		log.Printf("handlePaymentIntentSucceeded: Error retrieving order after succesful payment: %v\n", err)
 		return err
 	}
 	client_info := formClientInfo(payment_intent)
 
-	err = submitOrder(items, client_info)
-	if err != nil {
-		log.Printf("handlePaymentIntentSucceeded: Error in handling order submission: %v\n", err)
-		return err
-	} else {
-		shopping_cart, err := cart.Repo.GetCartByPaymentIntentID(client_info.PaymentIntentID)
-		if err != nil {
-			log.Printf("handlePaymentIntentSucceeded: Could not retrieve cart to clear session id: %v\n", err)
+	switch order.Status {
+	case cart.OrderPendingPayment:
+		if phone := dropInvalidPhone(client_info); phone != "" {
+			log.Printf("handlePaymentIntentSucceeded: Dropped invalid phone number of order %d\n", order.ID)
+			cart.Repo.AddOrderEvent(order.ID, "phone_dropped", phone)
+		}
+		// Also normalizes the address before it is stored
+		address_reason := addressReviewReason(client_info)
+		order.Customer = customerFromClientInfo(client_info)
+		if err := cart.Repo.UpdateOrderCustomer(order.ID, order.Customer); err != nil {
+			log.Printf("handlePaymentIntentSucceeded: Could not store customer for order %d: %v\n", order.ID, err)
+			return err
+		}
+
+		// The label is what the customer looks their order up with, so it is
+		// assigned as soon as they've paid.
+		if err := assignOrderLabel(order); err != nil {
+			return err
+		}
+
+		// Hold the order instead of fulfilling it if what was paid doesn't
+		// match what was priced, Printify couldn't ship it to the address, or
+		// its promo code was used up by another order in the meantime.
+		reason := verifyPayment(order, payment_intent)
+		if reason == "" {
+			reason = address_reason
+		}
+		if reason == "" {
+			reason = redeemPromoCode(order, true)
+		}
+		if reason != "" {
+			log.Printf("handlePaymentIntentSucceeded: Holding order %d for review: %s\n", order.ID, reason)
+			notify.AlertOwner("order_needs_review", fmt.Sprint(order.ID),
+				fmt.Sprintf("Order %d was paid but is held for review: %s. Approve it with -approve-order=%d", order.ID, reason, order.ID))
+			if err := cart.Repo.UpdateOrderReviewReason(order.ID, reason); err != nil {
+				return err
+			}
+			if err := cart.Repo.UpdateOrderStatus(order.ID, cart.OrderNeedsReview); err != nil {
+				return err
+			}
+			notify.Enqueue(notify.OrderConfirmation, order.ID, "")
+			clearPaidCart(payment_intent.ID)
 			return nil
 		}
-		// replace user's session id with another random session id so their
-		// cart will be cleared for them, but it won't be deleted from the db.
-		err = cart.Repo.UpdateSessionID(shopping_cart.SessionID, session.SessionId())
-		if err != nil {
-			log.Printf("handlePaymentIntentSucceeded: Could not clear session id: %v\n", err)
+
+		if err := cart.Repo.UpdateOrderStatus(order.ID, cart.OrderPaid); err != nil {
+			log.Printf("handlePaymentIntentSucceeded: Could not mark order %d paid: %v\n", order.ID, err)
+			return err
 		}
+		notify.Enqueue(notify.OrderConfirmation, order.ID, "")
+	case cart.OrderPaid:
+		// A previous attempt may have failed before queueing the submission.
+		// enqueueOrderSubmission won't queue a second job for the order.
+		log.Printf("handlePaymentIntentSucceeded: Order %d is already paid\n", order.ID)
+	default:
+		log.Printf("handlePaymentIntentSucceeded: Order %d is already %s\n", order.ID, order.Status)
+		return nil
+	}
+
+	// Submission to Printify happens in the job worker so the webhook can
+	// respond right away and failures are retried with backoff.
+	if err := enqueueOrderSubmission(order.ID); err != nil {
+		log.Printf("handlePaymentIntentSucceeded: Could not queue submission of order %d: %v\n", order.ID, err)
+		return err
 	}
 
+	clearPaidCart(payment_intent.ID)
 	return nil
 }
 
+// The order snapshot holds the items once the payment succeeded, so the
+// customer's cart can be cleared.
+func clearPaidCart(payment_intent_id string) {
+	shopping_cart, err := cart.Repo.GetCartByPaymentIntentID(payment_intent_id)
+	if err != nil {
+		log.Printf("clearPaidCart: Could not retrieve cart to clear session id: %v\n", err)
+		return
+	}
+	if err := cart.Repo.UpdateCartState(shopping_cart.ID, cart.CartPaid); err != nil {
+		log.Printf("clearPaidCart: Could not mark cart %d paid: %v\n", shopping_cart.ID, err)
+	}
+	// Revoke the session so the customer's next request gets a new one with
+	// an empty cart. The paid cart stays in the db with the old session id.
+	if err := session.Revoke(shopping_cart.SessionID); err != nil {
+		log.Printf("clearPaidCart: Could not revoke session of cart %d: %v\n", shopping_cart.ID, err)
+	}
+}
+
 func formClientInfo(payment_intent stripe.PaymentIntent) *ClientInfo {
-	addr := Address{
-		Line1:      payment_intent.Shipping.Address.Line1,
-		Line2:      payment_intent.Shipping.Address.Line2,
-		City:       payment_intent.Shipping.Address.City,
-		Country:    payment_intent.Shipping.Address.Country,
-		PostalCode: payment_intent.Shipping.Address.PostalCode,
-		State:      payment_intent.Shipping.Address.State,
-	}
-	return &ClientInfo{
+	client_info := &ClientInfo{
 		ClientSecret:    payment_intent.ClientSecret,
 		PaymentIntentID: payment_intent.ID,
-		Name:            payment_intent.Shipping.Name,
-		Address:         &addr,
+		Address:         &Address{},
 		Email:           payment_intent.ReceiptEmail,
 	}
+	if payment_intent.Shipping == nil {
+		return client_info
+	}
+
+	client_info.Name = payment_intent.Shipping.Name
+	client_info.Phone = payment_intent.Shipping.Phone
+	if addr := payment_intent.Shipping.Address; addr != nil {
+		client_info.Address = &Address{
+			Line1:      addr.Line1,
+			Line2:      addr.Line2,
+			City:       addr.City,
+			Country:    addr.Country,
+			PostalCode: addr.PostalCode,
+			State:      addr.State,
+		}
+	}
+	return client_info
 }
@@ -0,0 +1,247 @@
+package site
+
+/* Let customers look up their order with its label and their email */
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"server/cart"
+	"server/catalog"
+	"server/config"
+	"server/error_messages"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/csrf"
+)
+
+var (
+	// Every lookup from an address counts towards its limit
+	lookupsByIP = newRateLimiter(20, 10*time.Minute)
+	// Wrong emails for a label count towards the label's limit, so one label
+	// can't be guessed at from many addresses
+	failuresByLabel = newRateLimiter(5, time.Hour)
+)
+
+type orderStatusRequest struct {
+	Label string `json:"label"`
+	Email string `json:"email"`
+}
+
+type orderStatusResponse struct {
+	Label     string              `json:"label"`
+	Status    string              `json:"status"`
+	PlacedAt  string              `json:"placed_at"`
+	Total     string              `json:"total"`
+	Items     []orderStatusItem   `json:"items"`
+	Shipments []orderShipmentInfo `json:"shipments"`
+}
+
+type orderStatusItem struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Size     string `json:"size"`
+	Color    string `json:"color"`
+	Quantity int64  `json:"quantity"`
+	Price    string `json:"price"`
+}
+
+type orderShipmentInfo struct {
+	Carrier        string `json:"carrier"`
+	TrackingNumber string `json:"tracking_number"`
+	TrackingURL    string `json:"tracking_url"`
+	ShippedAt      string `json:"shipped_at,omitempty"`
+	DeliveredAt    string `json:"delivered_at,omitempty"`
+}
+
+/* POST {label, email} or GET ?token= from an order status link. Unknown labels
+ * and wrong emails get the same 404 so neither can be probed for. */
+func retrieveOrderStatus(w http.ResponseWriter, r *http.Request) {
+	if !lookupsByIP.Allow(clientIP(r)) {
+		error_rate_limited(w, "retrieveOrderStatus", clientIP(r))
+		return
+	}
+
+	var order *cart.Order
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		order, err = orderByToken(r.URL.Query().Get("token"))
+	case http.MethodPost:
+		var req orderStatusRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			error_bad_request(w, "retrieveOrderStatus: Can not decode JSON", err)
+			return
+		}
+		label, ok := normalizeLabel(req.Label)
+		if !ok {
+			error_bad_request(w, "retrieveOrderStatus: Invalid label", error_messages.ErrNotExists)
+			return
+		}
+		if failuresByLabel.Exceeded(label) {
+			error_rate_limited(w, "retrieveOrderStatus", "label "+label)
+			return
+		}
+		order, err = orderByLabelAndEmail(label, req.Email)
+		if err == error_messages.ErrNotExists {
+			failuresByLabel.Allow(label)
+		}
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err == error_messages.ErrNotExists {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error in retrieveOrderStatus: %v\n", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	resp, err := formOrderStatusResponse(order)
+	if err != nil {
+		log.Printf("Error in retrieveOrderStatus: Could not retrieve shipments of order %d: %v\n", order.ID, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	jsonResp, err := json.Marshal(resp)
+	if err != nil {
+		log.Printf("Error in retrieveOrderStatus: %v\n", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-CSRF-Token", csrf.Token(r))
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonResp)
+}
+
+func orderByLabelAndEmail(label string, email string) (*cart.Order, error) {
+	order, err := cart.Repo.GetOrderByLabel(label)
+	if err != nil {
+		return nil, err
+	}
+
+	given := strings.ToLower(strings.TrimSpace(email))
+	stored := strings.ToLower(strings.TrimSpace(order.Customer.Email))
+	if stored == "" || subtle.ConstantTimeCompare([]byte(given), []byte(stored)) != 1 {
+		return nil, error_messages.ErrNotExists
+	}
+	return order, nil
+}
+
+func orderByToken(token string) (*cart.Order, error) {
+	label, signature, ok := strings.Cut(token, ".")
+	if !ok || config.ORDER_TOKEN_SECRET == "" {
+		return nil, error_messages.ErrNotExists
+	}
+	if !hmac.Equal([]byte(signature), []byte(orderTokenSignature(label))) {
+		return nil, error_messages.ErrNotExists
+	}
+	return cart.Repo.GetOrderByLabel(label)
+}
+
+// Token for an order status link that doesn't need the customer's email.
+// Returns an empty string if ORDER_TOKEN_SECRET isn't set.
+func OrderStatusToken(label string) string {
+	if config.ORDER_TOKEN_SECRET == "" {
+		return ""
+	}
+	return label + "." + orderTokenSignature(label)
+}
+
+func orderTokenSignature(label string) string {
+	mac := hmac.New(sha256.New, []byte(config.ORDER_TOKEN_SECRET))
+	mac.Write([]byte("order:" + label))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// Labels are zero padded to 5 digits, but accept them without the padding
+func normalizeLabel(label string) (string, bool) {
+	label = strings.TrimPrefix(strings.TrimSpace(label), "#")
+	if label == "" || len(label) > 10 {
+		return "", false
+	}
+	num, err := strconv.ParseInt(label, 10, 64)
+	if err != nil || num < 1 {
+		return "", false
+	}
+	return fmt.Sprintf("%05d", num), true
+}
+
+func formOrderStatusResponse(order *cart.Order) (*orderStatusResponse, error) {
+	resp := &orderStatusResponse{
+		Label:     order.Label,
+		Status:    customerStatus(order.Status),
+		PlacedAt:  order.CreatedAt.Format(time.RFC3339),
+		Total:     catalog.FormatPrice(order.Total),
+		Items:     []orderStatusItem{},
+		Shipments: []orderShipmentInfo{},
+	}
+
+	for _, item := range order.Items {
+		name := item.Item
+		if product, ok := catalog.Store.Product(item.Item); ok {
+			name = product.Name
+		}
+		resp.Items = append(resp.Items, orderStatusItem{
+			ID:       item.Item,
+			Name:     name,
+			Size:     item.Size,
+			Color:    item.Color,
+			Quantity: item.Quantity,
+			Price:    catalog.FormatPrice(item.UnitPrice),
+		})
+	}
+
+	shipments, err := cart.Repo.GetOrderShipments(order.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, shipment := range shipments {
+		info := orderShipmentInfo{
+			Carrier:        shipment.Carrier,
+			TrackingNumber: shipment.TrackingNumber,
+			TrackingURL:    shipment.TrackingURL,
+		}
+		if !shipment.ShippedAt.IsZero() {
+			info.ShippedAt = shipment.ShippedAt.Format(time.RFC3339)
+		}
+		if !shipment.DeliveredAt.IsZero() {
+			info.DeliveredAt = shipment.DeliveredAt.Format(time.RFC3339)
+		}
+		resp.Shipments = append(resp.Shipments, info)
+	}
+
+	return resp, nil
+}
+
+// Customers don't need to know about reviews or resubmissions
+func customerStatus(status cart.OrderStatus) string {
+	switch status {
+	case cart.OrderPendingPayment:
+		return "awaiting_payment"
+	case cart.OrderNeedsReview, cart.OrderPaid, cart.OrderSubmissionFailed, cart.OrderSubmitted:
+		return "processing"
+	}
+	return string(status)
+}
+
+func error_rate_limited(w http.ResponseWriter, print string, key string) {
+	log.Printf("Error in %s: Too many requests from %s\n", print, key)
+	w.Header().Set("Retry-After", "600")
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write([]byte("Too Many Requests"))
+}
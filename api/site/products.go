@@ -0,0 +1,125 @@
+package site
+
+/* Public catalog endpoints so the frontend can list what is for sale */
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"server/catalog"
+	"strings"
+)
+
+type productResponse struct {
+	ID         string            `json:"id"`
+	Name       string            `json:"name"`
+	Price      string            `json:"price"` // Lowest variant price
+	PriceCents int64             `json:"price_cents"`
+	Sizes      []string          `json:"sizes"`
+	Colors     []string          `json:"colors"`
+	Available  bool              `json:"available"`
+	Variants   []variantResponse `json:"variants"`
+}
+
+type variantResponse struct {
+	Size       string `json:"size"`
+	Color      string `json:"color"`
+	Price      string `json:"price"`
+	PriceCents int64  `json:"price_cents"`
+	Available  bool   `json:"available"`
+	ImgSrc     string `json:"imgsrc"`
+	MockupSrc  string `json:"mockup,omitempty"`
+}
+
+/* GET /api/products lists every product, GET /api/products/{id} returns one */
+func retrieveProducts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body interface{}
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/products"), "/")
+	if id == "" {
+		products := []productResponse{}
+		for _, product := range catalog.Store.Products {
+			products = append(products, formProductResponse(product))
+		}
+		body = products
+	} else {
+		product, ok := catalog.Store.Product(id)
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		body = formProductResponse(product)
+	}
+
+	jsonResp, err := json.Marshal(body)
+	if err != nil {
+		log.Printf("Error in retrieveProducts: %v\n", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Availability changes whenever the catalog is synced, so let clients
+	// cache briefly and revalidate with the ETag.
+	sum := sha256.Sum256(jsonResp)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "public, max-age=300")
+
+	if match := r.Header.Get("If-None-Match"); match != "" && etagMatches(match, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodGet {
+		w.Write(jsonResp)
+	}
+}
+
+func formProductResponse(product *catalog.Product) productResponse {
+	resp := productResponse{
+		ID:         product.ID,
+		Name:       product.Name,
+		Price:      catalog.FormatPrice(product.MinPrice()),
+		PriceCents: product.MinPrice(),
+		Sizes:      product.Sizes,
+		Colors:     product.Colors,
+		Variants:   []variantResponse{},
+	}
+
+	for _, variant := range product.Variants() {
+		v := variantResponse{
+			Size:       variant.Size,
+			Color:      variant.Color,
+			Price:      variant.DisplayPrice(),
+			PriceCents: variant.Price(),
+			Available:  variant.Available(),
+			ImgSrc:     variant.ImageKey(),
+		}
+		if pv, ok := variant.Printify(); ok {
+			v.MockupSrc = pv.Image
+		}
+		resp.Available = resp.Available || v.Available
+		resp.Variants = append(resp.Variants, v)
+	}
+
+	return resp
+}
+
+// Check an If-None-Match header, which may list several ETags or "*"
+func etagMatches(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+package site
+
+/* Apply and remove the promo code on the client's cart */
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"server/api/external"
+	"server/cart"
+	"server/catalog"
+	"server/session"
+
+	"github.com/gorilla/csrf"
+)
+
+type promoResponse struct {
+	PromoCode    string `json:"promo_code"`
+	FreeShipping bool   `json:"free_shipping"`
+	Subtotal     string `json:"subtotal"`
+	Discount     string `json:"discount"`
+	Total        string `json:"total"` // Before shipping
+	Error        string `json:"error,omitempty"`
+}
+
+/* GET returns the applied code, POST {"code": "..."} applies one and DELETE
+ * removes it. Codes that can't be used respond 422 with the reason. */
+func handlePromoCode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.Method == http.MethodPost && !lookupsByIP.Allow(clientIP(r)) {
+		error_rate_limited(w, "handlePromoCode", clientIP(r))
+		return
+	}
+
+	shopping_cart, err := session.RetrieveCart(w, r)
+	if err != nil {
+		error_server(w, "handlePromoCode: Failed to retrieve/create session", err)
+		return
+	}
+
+	if r.Method != http.MethodGet && !external.UnlockCart(shopping_cart) {
+		error_cart_locked(w, "handlePromoCode", shopping_cart)
+		return
+	}
+
+	items, err := session.RetrieveItems(shopping_cart.SessionID)
+	if err != nil {
+		error_bad_request(w, "handlePromoCode: Could not retrieve items", err)
+		return
+	}
+
+	code := shopping_cart.PromoCode
+	switch r.Method {
+	case http.MethodPost:
+		var req struct {
+			Code string `json:"code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			error_bad_request(w, "handlePromoCode: Can not decode JSON", err)
+			return
+		}
+		code = cart.NormalizePromoCode(req.Code)
+	case http.MethodDelete:
+		code = ""
+	}
+
+	amounts, err := cart.CartAmounts(items, 0, code, "")
+	status := http.StatusOK
+	resp := promoResponse{}
+	if cart.IsPromoError(err) {
+		log.Printf("handlePromoCode: %s: %s: %v\n", shopping_cart.SessionID, code, err)
+		resp.Error = err.Error()
+		if r.Method == http.MethodPost {
+			status = http.StatusUnprocessableEntity
+		}
+		// A rejected code leaves the code that was applied before in place
+		if r.Method == http.MethodPost && code != shopping_cart.PromoCode {
+			code = shopping_cart.PromoCode
+			amounts, err = cart.CartAmounts(items, 0, code, "")
+		}
+		// CartAmounts prices the cart without a code that can't be used
+		if cart.IsPromoError(err) {
+			code = ""
+			err = nil
+		}
+	}
+	if err != nil {
+		error_bad_request(w, "handlePromoCode: Could not price cart", err)
+		return
+	}
+
+	if code != shopping_cart.PromoCode {
+		if err := cart.Repo.UpdateCartPromoCode(shopping_cart.ID, code); err != nil {
+			error_bad_request(w, "handlePromoCode: Could not update promo code", err)
+			return
+		}
+		log.Printf("%s: Promo code set to %q\n", shopping_cart.SessionID, code)
+	}
+
+	resp.PromoCode = amounts.PromoCode
+	resp.Subtotal = catalog.FormatPrice(amounts.Subtotal)
+	resp.Discount = catalog.FormatPrice(amounts.Discount)
+	resp.Total = catalog.FormatPrice(amounts.Total)
+	if promo, err := cart.Repo.GetPromoCode(amounts.PromoCode); err == nil {
+		resp.FreeShipping = promo.Kind == cart.PromoFreeShipping
+	}
+
+	jsonResp, err := json.Marshal(resp)
+	if err != nil {
+		error_bad_request(w, "handlePromoCode: Could not encode response", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-CSRF-Token", csrf.Token(r))
+	w.WriteHeader(status)
+	w.Write(jsonResp)
+}
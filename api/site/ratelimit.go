@@ -0,0 +1,90 @@
+package site
+
+/* In-memory fixed window rate limiting for endpoints that can be enumerated */
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type rateLimiter struct {
+	mu         sync.Mutex
+	limit      int
+	window     time.Duration
+	windows    map[string]*rateWindow
+	last_sweep time.Time
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{
+		limit:   limit,
+		window:  window,
+		windows: map[string]*rateWindow{},
+	}
+}
+
+// Count a hit for key, returning false once key is over the limit for the
+// current window.
+func (l *rateLimiter) Allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	w := l.current(key)
+	w.count++
+	return w.count <= l.limit
+}
+
+// Whether key already used up the current window, without counting a hit
+func (l *rateLimiter) Exceeded(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.current(key).count >= l.limit
+}
+
+// Must be called with l.mu held
+func (l *rateLimiter) current(key string) *rateWindow {
+	now := time.Now()
+
+	// Drop expired windows now and then so the map doesn't grow forever
+	if now.Sub(l.last_sweep) > l.window {
+		for k, w := range l.windows {
+			if now.Sub(w.start) > l.window {
+				delete(l.windows, k)
+			}
+		}
+		l.last_sweep = now
+	}
+
+	w, ok := l.windows[key]
+	if !ok || now.Sub(w.start) > l.window {
+		w = &rateWindow{start: now}
+		l.windows[key] = w
+	}
+	return w
+}
+
+// The address of the client. The server listens on localhost behind a proxy,
+// which appends the real address to X-Forwarded-For.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			addrs := strings.Split(forwarded, ",")
+			return strings.TrimSpace(addrs[len(addrs)-1])
+		}
+	}
+	return host
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"server/api/external"
 	"server/cart"
 	"server/error_messages"
 	"server/session"
@@ -13,10 +14,14 @@ import (
 
 func InitHandlers(mux *http.ServeMux) {
 	mux.HandleFunc("/api/items", retrieveItemCount)
+	mux.HandleFunc("/api/products", retrieveProducts)
+	mux.HandleFunc("/api/products/", retrieveProducts)
 	mux.HandleFunc("/api/retrieve_cart", retrieveCartItems)
 	mux.HandleFunc("/api/add_to_cart", addToCart)
 	mux.HandleFunc("/api/remove_from_cart", removeFromCart)
-	mux.HandleFunc("/api/checkout", removeFromCart)
+	mux.HandleFunc("/api/update_quantity", updateQuantity)
+	mux.HandleFunc("/api/order_status", retrieveOrderStatus)
+	mux.HandleFunc("/api/promo", handlePromoCode)
 }
 
 /* Send the number item's in the client's cart in a response */
@@ -24,7 +29,11 @@ func retrieveItemCount(w http.ResponseWriter, r *http.Request) {
 	/* We do not need to store the user's session id in the database for this
 	 * request unless it is there already, so we call BeginSession instead of
 	 * RetrieveCart */
-	session_id := session.BeginSession(w, r)
+	session_id, err := session.BeginSession(w, r)
+	if err != nil {
+		error_server(w, "retrieveItemCount: Failed to begin session", err)
+		return
+	}
 
 	retrieved_items, err := session.RetrieveItems(session_id)
 	if err != error_messages.ErrNotExists && err != nil {
@@ -32,7 +41,7 @@ func retrieveItemCount(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	numItems := len(retrieved_items)
+	numItems := int(cart.TotalQuantity(retrieved_items))
 	obj := map[string]int{"items": numItems}
 	jsonResp, err := json.Marshal(obj)
 
@@ -47,7 +56,11 @@ func retrieveCartItems(w http.ResponseWriter, r *http.Request) {
 	/* We do not need to store the user's session id in the database for this
 	 * request unless it is there already, so we call BeginSession instead of
 	 * RetrieveCart */
-	session_id := session.BeginSession(w, r)
+	session_id, err := session.BeginSession(w, r)
+	if err != nil {
+		error_server(w, "retrieveCartItems: Failed to begin session", err)
+		return
+	}
 
 	retrieved_items, err := session.RetrieveItems(session_id)
 	if err != error_messages.ErrNotExists && err != nil {
@@ -76,12 +89,22 @@ func addToCart(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if variant, _ := item.Variant(); !variant.Available() {
+		error_bad_request(w, "addToCart: Item is not available", error_messages.ErrUnavailableItem)
+		return
+	}
+
 	/* session.RetrieveCart will check/create the user's cookie containing
 	 * their session id and uses the session id to create/retrieve a shopping
 	 * cart entry in the database */
 	shopping_cart, err := session.RetrieveCart(w, r)
 	if err != nil {
-		error_bad_request(w, "addToCart: Failed to retrieve/create session", err)
+		error_server(w, "addToCart: Failed to retrieve/create session", err)
+		return
+	}
+
+	if !external.UnlockCart(shopping_cart) {
+		error_cart_locked(w, "addToCart", shopping_cart)
 		return
 	}
 
@@ -91,14 +114,23 @@ func addToCart(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	numItems := len(retrieved_items)
-	if numItems >= 8 {
+	if item.Quantity == 0 {
+		item.Quantity = 1
+	}
+
+	if cart.TotalQuantity(retrieved_items)+item.Quantity > cart.MaxQuantity {
 		error_bad_request(w, "addToCart: Too many items are in the user's cart", err)
 		return
 	}
 
+	// Identical variants share a row, so adding one again raises its quantity
 	item.ShoppingCartID = shopping_cart.ID
-	_, err = cart.Repo.CreateItemEntry(*item)
+	existing, err := cart.Repo.GetItem(*item)
+	if err == nil {
+		err = cart.Repo.UpdateItemQuantity(existing.ID, existing.Quantity+item.Quantity)
+	} else if err == error_messages.ErrNotExists {
+		_, err = cart.Repo.CreateItemEntry(*item)
+	}
 
 	if err != nil {
 		error_bad_request(w, "addToCart: Failed to create item", err)
@@ -128,12 +160,25 @@ func removeFromCart(w http.ResponseWriter, r *http.Request) {
 	shopping_cart, err := session.RetrieveCart(w, r)
 
 	if err != nil {
-		error_bad_request(w, "removeFromCart: Failed to retrieve/create session", err)
+		error_server(w, "removeFromCart: Failed to retrieve/create session", err)
+		return
+	}
+
+	if !external.UnlockCart(shopping_cart) {
+		error_cart_locked(w, "removeFromCart", shopping_cart)
 		return
 	}
 
+	// Remove a single unit, deleting the row when it was the last one
 	item.ShoppingCartID = shopping_cart.ID
-	err = cart.Repo.DeleteItem(*item)
+	existing, err := cart.Repo.GetItem(*item)
+	if err == nil {
+		if existing.Quantity > 1 {
+			err = cart.Repo.UpdateItemQuantity(existing.ID, existing.Quantity-1)
+		} else {
+			err = cart.Repo.DeleteItem(*item)
+		}
+	}
 
 	if err != nil {
 		error_bad_request(w, "removeFromCart: Failed to delete item", err)
@@ -148,6 +193,86 @@ func removeFromCart(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("Successful Request"))
 }
 
+/* Set the number of units of a variant in the client's cart. A quantity of
+ * zero removes the variant. */
+func updateQuantity(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPatch && r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		log.Printf("updateQuantity: Wrong request method: %s\n", r.Method)
+		return
+	}
+
+	item, err := validate_item(r)
+
+	if err != nil {
+		error_bad_request(w, "updateQuantity: Can not decode JSON", err)
+		return
+	}
+
+	shopping_cart, err := session.RetrieveCart(w, r)
+	if err != nil {
+		error_server(w, "updateQuantity: Failed to retrieve/create session", err)
+		return
+	}
+
+	if !external.UnlockCart(shopping_cart) {
+		error_cart_locked(w, "updateQuantity", shopping_cart)
+		return
+	}
+
+	retrieved_items, err := cart.Repo.GetItemsBySessionID(shopping_cart.SessionID)
+	if err != nil {
+		error_bad_request(w, "updateQuantity: Could not retrieve items", err)
+		return
+	}
+
+	item.ShoppingCartID = shopping_cart.ID
+	existing, err := cart.Repo.GetItem(*item)
+	if err != nil && err != error_messages.ErrNotExists {
+		error_bad_request(w, "updateQuantity: Could not retrieve item", err)
+		return
+	}
+
+	var current int64 = 0
+	if existing != nil {
+		current = existing.Quantity
+	}
+
+	if item.Quantity > current {
+		if variant, _ := item.Variant(); !variant.Available() {
+			error_bad_request(w, "updateQuantity: Item is not available", error_messages.ErrUnavailableItem)
+			return
+		}
+		if cart.TotalQuantity(retrieved_items)-current+item.Quantity > cart.MaxQuantity {
+			error_bad_request(w, "updateQuantity: Too many items are in the user's cart", nil)
+			return
+		}
+	}
+
+	switch {
+	case existing == nil && item.Quantity == 0:
+		err = nil
+	case existing == nil:
+		_, err = cart.Repo.CreateItemEntry(*item)
+	case item.Quantity == 0:
+		err = cart.Repo.DeleteItem(*item)
+	default:
+		err = cart.Repo.UpdateItemQuantity(existing.ID, item.Quantity)
+	}
+
+	if err != nil {
+		error_bad_request(w, "updateQuantity: Failed to update item", err)
+		return
+	}
+
+	log.Printf("%s: Set %s quantity to %d\n", shopping_cart.SessionID, item.Item, item.Quantity)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-CSRF-Token", csrf.Token(r))
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Successful Request"))
+}
+
 /* Decode JSON object and ensure that each field for the item contains a valid
  * value. */
 func validate_item(r *http.Request) (*cart.CartItem, error) {
@@ -159,22 +284,30 @@ func validate_item(r *http.Request) (*cart.CartItem, error) {
 		return nil, err
 	}
 
-	if !contains(cart.Items, item.Item) || !contains(cart.Sizes, item.Size) || !contains(cart.Colors, item.Color) {
-		log.Printf("Error in validate_item(): %v\n", error_messages.ErrInvalidItem)
+	if _, err := item.Variant(); err != nil {
+		log.Printf("Error in validate_item(): %v\n", err)
+		return nil, err
+	}
+
+	if item.Quantity < 0 || item.Quantity > cart.MaxQuantity {
+		log.Printf("Error in validate_item(): invalid quantity %d\n", item.Quantity)
 		return nil, error_messages.ErrInvalidItem
 	}
 
 	return &item, nil
 }
 
-// contains checks if a value is present in a slice
-func contains(s []string, str string) bool {
-	for _, v := range s {
-		if v == str {
-			return true
-		}
-	}
-	return false
+// Carts can't be changed while a payment for them is in flight
+func error_cart_locked(w http.ResponseWriter, print string, shopping_cart *cart.ShoppingCart) {
+	log.Printf("Error in %s: Cart %d is %s\n", print, shopping_cart.ID, shopping_cart.State)
+	w.WriteHeader(http.StatusConflict)
+	w.Write([]byte("Cart is locked for checkout"))
+}
+
+func error_server(w http.ResponseWriter, print string, err error) {
+	log.Printf("Error in %s: %v\n", print, err)
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write([]byte("Internal Server Error"))
 }
 
 func error_bad_request(w http.ResponseWriter, print string, err error) {
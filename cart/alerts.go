@@ -0,0 +1,48 @@
+package cart
+
+/* When owner alerts were last sent, so repeats are held back across restarts
+ * and command line runs, see notify.AlertOwner */
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Record that the alert with this id was raised. Returns whether to send it
+// and how many times it was raised since it was last sent, including this
+// time. An alert sent less than interval ago is only counted.
+func (r *SQLiteDatabase) RecordAlert(id string, now time.Time, interval time.Duration) (bool, int, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return false, 0, err
+	}
+	defer tx.Rollback()
+
+	var sent_at int64
+	var suppressed int
+	err = tx.QueryRow("SELECT sent_at, suppressed FROM alerts WHERE id = ?", id).Scan(&sent_at, &suppressed)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+	case err != nil:
+		return false, 0, err
+	case now.Sub(time.Unix(sent_at, 0)) < interval:
+		if _, err := tx.Exec("UPDATE alerts SET suppressed = suppressed + 1 WHERE id = ?", id); err != nil {
+			return false, 0, err
+		}
+		return false, 0, tx.Commit()
+	}
+
+	_, err = tx.Exec("INSERT INTO alerts(id, sent_at, suppressed) values(?,?,0) ON CONFLICT(id) DO UPDATE SET sent_at = excluded.sent_at, suppressed = 0",
+		id, now.Unix())
+	if err != nil {
+		return false, 0, err
+	}
+
+	// Alerts that haven't been raised again since they were sent are done with
+	if _, err := tx.Exec("DELETE FROM alerts WHERE sent_at < ? AND suppressed = 0", now.Add(-interval).Unix()); err != nil {
+		return false, 0, err
+	}
+
+	return true, suppressed + 1, tx.Commit()
+}
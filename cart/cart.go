@@ -2,31 +2,33 @@ package cart
 
 import (
 	"database/sql"
+	"server/catalog"
 	"strings"
 )
 
-/* 
-    TODO:
-    Change the contents of this file to fit your own store's custom SKU structure
-    and product lineup. Values are placeholders that I may later externalize to
-    the configuration.
-
-    Find and replace: PLACEHOLDER
-*/
-
-var (
-	Items  = []string{"sweatshirt", "tshirt", "hoodie"}
-	Sizes  = []string{"s", "m", "l", "xl", "2xl", "3xl"}
-	Colors = []string{"black", "red", "green"}
-	// These values are used to charge the user
-	ItemtoPrice        = map[string]int64{"sweatshirt": 3000, "tshirt": 3000, "hoodie": 3000}
-	ItemtoDisplayPrice = map[string]string{"sweatshirt": "$30", "tshirt": "$30", "hoodie": "$30"}
+// The product lineup, prices and SKU structure are loaded from the catalog
+// file, see catalog.json and the catalog package.
+
+type CartState string
+
+const (
+	CartOpen CartState = "open"
+	// A PaymentIntent is in flight, the items can't change until it is
+	// canceled or fails.
+	CartCheckingOut CartState = "checking_out"
+	CartPaid        CartState = "paid"
 )
 
+// Most units a single cart may hold, and be checked out with
+const MaxQuantity = 8
+
 type ShoppingCart struct {
 	ID              int64
 	SessionID       string
 	PaymentIntentID string
+	State           CartState
+	// Promo code applied to the cart, empty if there is none
+	PromoCode string
 }
 
 type CartItem struct {
@@ -35,6 +37,9 @@ type CartItem struct {
 	Item           string `json:"id"`
 	Size           string `json:"size"`
 	Color          string `json:"color"`
+	Quantity       int64  `json:"quantity"`
+	// Price per unit in cents locked in at checkout, 0 until then
+	UnitPrice int64 `json:"-"`
 	// Last three parameters are strictly for displaying
 	// the cart item on the /cart page
 	Display struct {
@@ -50,51 +55,70 @@ type SQLiteDatabase struct {
 
 // Fills in some of the struct details that are only needed for the /cart page
 func AddDisplayDetails(item CartItem) CartItem {
-	item.Display.Name = "PLACEHOLDER "
+	item.Display.Name = item.Item
 	item.Display.ImgSrc = item.Item + "_" + item.Color
+
+	variant, err := item.Variant()
+	if err == nil {
+		item.Display.Name = variant.Product.Name
+		item.Display.ImgSrc = variant.ImageKey()
+		item.Display.Price = variant.DisplayPrice()
+	}
+
 	item.Color = strings.Title(item.Color)
 	item.Size = strings.ToUpper(item.Size)
+	return item
+}
 
-	id := item.Item
-	item.Display.Price = ItemtoDisplayPrice[id]
-	switch {
-	case id == "tshirt":
-		item.Display.Name = item.Display.Name + "T-Shirt"
-	case id == "hoodie":
-		item.Display.Name = item.Display.Name + "Hoodie"
-	case id == "sweatshirt":
-		item.Display.Name = item.Display.Name + "Sweatshirt"
+// Total number of units across all items
+func TotalQuantity(items []CartItem) int64 {
+	var total int64 = 0
+	for _, item := range items {
+		total += item.Quantity
 	}
-	return item
+	return total
+}
+
+// Merge items of the same item, size and color into one item carrying the
+// combined quantity, keeping the order in which they first appear.
+func AggregateItems(items []CartItem) []CartItem {
+	aggregated := []CartItem{}
+	index := map[string]int{}
+	for _, item := range items {
+		key := item.Item + "/" + item.Size + "/" + item.Color
+		if i, ok := index[key]; ok {
+			aggregated[i].Quantity += item.Quantity
+			continue
+		}
+		index[key] = len(aggregated)
+		aggregated = append(aggregated, item)
+	}
+	return aggregated
 }
 
-/*
-SKU Naming:
-
-	PLACEHOLDER_{item first initial}__{Size}_{Color first two
-	initials}
-
-	ex: PLACEHOLDER_S_S_BL
-	PLACEHOLDER_S = PLACEHOLDER_sweatshirt
-	S = small
-	BL = black
-*/
-func (item *CartItem) GetSKU() string {
-	SKU := "PLACEHOLDER_"
-	color := strings.ToUpper(item.Color[:2])
-	size := strings.ToUpper(item.Size)
-
-	id := item.Item
-	switch {
-	case id == "tshirt":
-		SKU = SKU + "T_"
-	case id == "hoodie":
-		SKU = SKU + "H_"
-	case id == "sweatshirt":
-		SKU = SKU + "S_"
+// The price charged per unit: the price locked in at checkout, or the
+// current catalog price if the item hasn't been through checkout.
+func (item *CartItem) Price() (int64, error) {
+	if item.UnitPrice > 0 {
+		return item.UnitPrice, nil
 	}
+	variant, err := item.Variant()
+	if err != nil {
+		return 0, err
+	}
+	return variant.Price(), nil
+}
 
-	SKU = SKU + size + "_" + color
+// Look up the catalog variant for a cart item
+func (item *CartItem) Variant() (*catalog.Variant, error) {
+	return catalog.Store.Variant(item.Item, item.Size, item.Color)
+}
 
-	return SKU
+// Returns the item's SKU built from the SKU template in the catalog
+func (item *CartItem) GetSKU() (string, error) {
+	variant, err := item.Variant()
+	if err != nil {
+		return "", err
+	}
+	return variant.SKU(), nil
 }
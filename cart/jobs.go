@@ -0,0 +1,212 @@
+package cart
+
+/* Storage for the background job queue, see the jobs package */
+
+import (
+	"database/sql"
+	"errors"
+	"server/error_messages"
+	"time"
+)
+
+type JobStatus string
+
+const (
+	JobPending JobStatus = "pending"
+	JobRunning JobStatus = "running"
+	JobDone    JobStatus = "done"
+	// Gave up after max_attempts, needs to be requeued by hand
+	JobDead JobStatus = "dead"
+)
+
+type Job struct {
+	ID          int64
+	Kind        string
+	Payload     string
+	Status      JobStatus
+	Attempts    int
+	MaxAttempts int
+	RunAt       time.Time
+	LastError   string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+const jobColumns = "id, kind, payload, status, attempts, max_attempts, run_at, last_error, created_at, updated_at"
+
+func (r *SQLiteDatabase) CreateJob(kind string, payload string, max_attempts int) (*Job, error) {
+	now := time.Now()
+	res, err := r.db.Exec("INSERT INTO jobs(kind, payload, status, max_attempts, run_at, created_at, updated_at) values(?,?,?,?,?,?,?)",
+		kind, payload, JobPending, max_attempts, now.Unix(), now.Unix(), now.Unix())
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	return r.GetJob(id)
+}
+
+// Return the first job of a kind with the given payload that hasn't died
+func (r *SQLiteDatabase) GetLiveJob(kind string, payload string) (*Job, error) {
+	row := r.db.QueryRow("SELECT "+jobColumns+" FROM jobs WHERE kind = ? AND payload = ? AND status != ? ORDER BY id LIMIT 1", kind, payload, JobDead)
+	job, err := scanJob(row)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, error_messages.ErrNotExists
+		}
+		return nil, err
+	}
+	return job, nil
+}
+
+// Return the newest job of a kind with the given payload, whatever its status
+func (r *SQLiteDatabase) GetLatestJob(kind string, payload string) (*Job, error) {
+	row := r.db.QueryRow("SELECT "+jobColumns+" FROM jobs WHERE kind = ? AND payload = ? ORDER BY id DESC LIMIT 1", kind, payload)
+	job, err := scanJob(row)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, error_messages.ErrNotExists
+		}
+		return nil, err
+	}
+	return job, nil
+}
+
+// Claim the oldest pending job that is due by marking it running. Returns
+// ErrNotExists when there is nothing to do.
+func (r *SQLiteDatabase) ClaimJob() (*Job, error) {
+	now := time.Now().Unix()
+	for {
+		row := r.db.QueryRow("SELECT "+jobColumns+" FROM jobs WHERE status = ? AND run_at <= ? ORDER BY run_at, id LIMIT 1", JobPending, now)
+		job, err := scanJob(row)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil, error_messages.ErrNotExists
+			}
+			return nil, err
+		}
+
+		res, err := r.db.Exec("UPDATE jobs SET status = ?, attempts = attempts + 1, updated_at = ? WHERE id = ? AND status = ?", JobRunning, now, job.ID, JobPending)
+		if err != nil {
+			return nil, err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return nil, err
+		} else if n == 0 {
+			// Claimed by someone else, try the next one
+			continue
+		}
+
+		job.Status = JobRunning
+		job.Attempts++
+		return job, nil
+	}
+}
+
+func (r *SQLiteDatabase) CompleteJob(id int64) error {
+	return r.updateJob(id, JobDone, "", time.Now())
+}
+
+// Record a failed attempt. The job runs again at run_at, or is moved to the
+// dead-letter status once it has used all of its attempts.
+func (r *SQLiteDatabase) FailJob(job *Job, last_error string, run_at time.Time) error {
+	status := JobPending
+	if job.Attempts >= job.MaxAttempts {
+		status = JobDead
+	}
+	return r.updateJob(job.ID, status, last_error, run_at)
+}
+
+// Put a job back in the queue with a fresh set of attempts. Jobs that are
+// running are left to the worker running them.
+func (r *SQLiteDatabase) RequeueJob(id int64) error {
+	now := time.Now().Unix()
+	res, err := r.db.Exec("UPDATE jobs SET status = ?, attempts = 0, run_at = ?, updated_at = ? WHERE id = ? AND status != ?", JobPending, now, now, id, JobRunning)
+	return checkJobUpdate(res, err)
+}
+
+// Jobs left running by a process that exited mid-job are made pending again
+func (r *SQLiteDatabase) ResetRunningJobs() (int64, error) {
+	res, err := r.db.Exec("UPDATE jobs SET status = ?, updated_at = ? WHERE status = ?", JobPending, time.Now().Unix(), JobRunning)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (r *SQLiteDatabase) updateJob(id int64, status JobStatus, last_error string, run_at time.Time) error {
+	res, err := r.db.Exec("UPDATE jobs SET status = ?, last_error = ?, run_at = ?, updated_at = ? WHERE id = ?", status, last_error, run_at.Unix(), time.Now().Unix(), id)
+	return checkJobUpdate(res, err)
+}
+
+func checkJobUpdate(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return error_messages.ErrUpdateFailed
+	}
+
+	return nil
+}
+
+func (r *SQLiteDatabase) GetJob(id int64) (*Job, error) {
+	row := r.db.QueryRow("SELECT "+jobColumns+" FROM jobs WHERE id = ?", id)
+	job, err := scanJob(row)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, error_messages.ErrNotExists
+		}
+		return nil, err
+	}
+	return job, nil
+}
+
+// Return every job in one of the given statuses, oldest first
+func (r *SQLiteDatabase) GetJobsByStatus(statuses ...JobStatus) ([]Job, error) {
+	var jobs []Job
+	for _, status := range statuses {
+		rows, err := r.db.Query("SELECT "+jobColumns+" FROM jobs WHERE status = ? ORDER BY id", status)
+		if err != nil {
+			return nil, err
+		}
+
+		for rows.Next() {
+			job, err := scanJob(rows)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			jobs = append(jobs, *job)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return jobs, nil
+}
+
+func scanJob(row rowScanner) (*Job, error) {
+	var job Job
+	var run_at, created_at, updated_at int64
+	err := row.Scan(&job.ID, &job.Kind, &job.Payload, &job.Status, &job.Attempts, &job.MaxAttempts, &run_at, &job.LastError, &created_at, &updated_at)
+	if err != nil {
+		return nil, err
+	}
+	job.RunAt = time.Unix(run_at, 0)
+	job.CreatedAt = time.Unix(created_at, 0)
+	job.UpdatedAt = time.Unix(updated_at, 0)
+	return &job, nil
+}
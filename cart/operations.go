@@ -20,7 +20,9 @@ func (r *SQLiteDatabase) Migrate() error {
     CREATE TABLE IF NOT EXISTS shopping_cart(
         id INTEGER PRIMARY KEY AUTOINCREMENT,
         session_id TEXT NOT NULL UNIQUE,
-		payment_intent_id TEXT
+		payment_intent_id TEXT,
+        state TEXT NOT NULL DEFAULT 'open',
+        promo_code TEXT NOT NULL DEFAULT ''
     );
     CREATE TABLE IF NOT EXISTS cart_item(
         id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -28,6 +30,8 @@ func (r *SQLiteDatabase) Migrate() error {
         item TEXT NOT NULL,
         size TEXT NOT NULL,
         color TEXT NOT NULL,
+        quantity INTEGER NOT NULL DEFAULT 1,
+        unit_price INTEGER NOT NULL DEFAULT 0,
 		FOREIGN KEY (shopping_cart_id)
 			REFERENCES shopping_cart (id)
 			ON DELETE CASCADE
@@ -39,9 +43,203 @@ func (r *SQLiteDatabase) Migrate() error {
 			REFERENCES shopping_cart (id)
 			ON DELETE CASCADE
     );
+    CREATE TABLE IF NOT EXISTS orders(
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        shopping_cart_id INTEGER,
+        payment_intent_id TEXT NOT NULL UNIQUE,
+        label TEXT NOT NULL DEFAULT '',
+        status TEXT NOT NULL,
+        subtotal INTEGER NOT NULL,
+        shipping INTEGER NOT NULL DEFAULT 0,
+        total INTEGER NOT NULL,
+        name TEXT NOT NULL DEFAULT '',
+        email TEXT NOT NULL DEFAULT '',
+        line1 TEXT NOT NULL DEFAULT '',
+        line2 TEXT NOT NULL DEFAULT '',
+        city TEXT NOT NULL DEFAULT '',
+        state TEXT NOT NULL DEFAULT '',
+        postal_code TEXT NOT NULL DEFAULT '',
+        country TEXT NOT NULL DEFAULT '',
+        printify_order_id TEXT NOT NULL DEFAULT '',
+        shipping_priced INTEGER NOT NULL DEFAULT 0,
+        review_reason TEXT NOT NULL DEFAULT '',
+        refunded INTEGER NOT NULL DEFAULT 0,
+        dispute_status TEXT NOT NULL DEFAULT '',
+        discount INTEGER NOT NULL DEFAULT 0,
+        promo_code TEXT NOT NULL DEFAULT '',
+        tax INTEGER NOT NULL DEFAULT 0,
+        shipping_method TEXT NOT NULL DEFAULT 'standard',
+        phone TEXT NOT NULL DEFAULT '',
+        submitting_at INTEGER NOT NULL DEFAULT 0,
+        created_at INTEGER NOT NULL,
+        updated_at INTEGER NOT NULL,
+		FOREIGN KEY (shopping_cart_id)
+			REFERENCES shopping_cart (id)
+			ON DELETE SET NULL
+    );
+    CREATE TABLE IF NOT EXISTS order_items(
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        order_id INTEGER NOT NULL,
+        item TEXT NOT NULL,
+        size TEXT NOT NULL,
+        color TEXT NOT NULL,
+        quantity INTEGER NOT NULL,
+        unit_price INTEGER NOT NULL,
+        sku TEXT NOT NULL,
+		FOREIGN KEY (order_id)
+			REFERENCES orders (id)
+			ON DELETE CASCADE
+    );
+    CREATE TABLE IF NOT EXISTS order_events(
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        order_id INTEGER NOT NULL,
+        event TEXT NOT NULL,
+        detail TEXT NOT NULL DEFAULT '',
+        created_at INTEGER NOT NULL,
+		FOREIGN KEY (order_id)
+			REFERENCES orders (id)
+			ON DELETE CASCADE
+    );
+    CREATE TABLE IF NOT EXISTS order_shipments(
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        order_id INTEGER NOT NULL,
+        carrier TEXT NOT NULL,
+        tracking_number TEXT NOT NULL,
+        tracking_url TEXT NOT NULL DEFAULT '',
+        shipped_at INTEGER NOT NULL DEFAULT 0,
+        delivered_at INTEGER NOT NULL DEFAULT 0,
+        UNIQUE (order_id, tracking_number),
+		FOREIGN KEY (order_id)
+			REFERENCES orders (id)
+			ON DELETE CASCADE
+    );
+    CREATE TABLE IF NOT EXISTS promo_codes(
+        code TEXT PRIMARY KEY,
+        kind TEXT NOT NULL,
+        amount INTEGER NOT NULL DEFAULT 0,
+        item TEXT NOT NULL DEFAULT '',
+        min_subtotal INTEGER NOT NULL DEFAULT 0,
+        starts_at INTEGER NOT NULL DEFAULT 0,
+        ends_at INTEGER NOT NULL DEFAULT 0,
+        max_uses INTEGER NOT NULL DEFAULT 0,
+        uses INTEGER NOT NULL DEFAULT 0,
+        once_per_email INTEGER NOT NULL DEFAULT 0,
+        created_at INTEGER NOT NULL
+    );
+    CREATE TABLE IF NOT EXISTS promo_redemptions(
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        code TEXT NOT NULL,
+        order_id INTEGER NOT NULL UNIQUE,
+        email TEXT NOT NULL,
+        discount INTEGER NOT NULL,
+        created_at INTEGER NOT NULL,
+		FOREIGN KEY (code)
+			REFERENCES promo_codes (code)
+			ON DELETE CASCADE
+    );
+    CREATE INDEX IF NOT EXISTS promo_redemptions_code_email ON promo_redemptions(code, email);
+    CREATE TABLE IF NOT EXISTS jobs(
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        kind TEXT NOT NULL,
+        payload TEXT NOT NULL,
+        status TEXT NOT NULL,
+        attempts INTEGER NOT NULL DEFAULT 0,
+        max_attempts INTEGER NOT NULL,
+        run_at INTEGER NOT NULL,
+        last_error TEXT NOT NULL DEFAULT '',
+        created_at INTEGER NOT NULL,
+        updated_at INTEGER NOT NULL
+    );
+    CREATE INDEX IF NOT EXISTS jobs_status_run_at ON jobs(status, run_at);
+    CREATE TABLE IF NOT EXISTS webhook_events(
+        event_id TEXT PRIMARY KEY,
+        type TEXT NOT NULL,
+        status TEXT NOT NULL,
+        attempts INTEGER NOT NULL DEFAULT 1,
+        last_error TEXT NOT NULL DEFAULT '',
+        received_at INTEGER NOT NULL,
+        updated_at INTEGER NOT NULL
+    );
+    CREATE TABLE IF NOT EXISTS alerts(
+        id TEXT PRIMARY KEY,
+        sent_at INTEGER NOT NULL,
+        suppressed INTEGER NOT NULL DEFAULT 0
+    );
+    CREATE TABLE IF NOT EXISTS sessions(
+        id TEXT PRIMARY KEY,
+        created_at INTEGER NOT NULL,
+        last_seen_at INTEGER NOT NULL,
+        expires_at INTEGER NOT NULL,
+        revoked_at INTEGER NOT NULL DEFAULT 0
+    );
+    CREATE INDEX IF NOT EXISTS sessions_expires_at ON sessions(expires_at);
+    CREATE TABLE IF NOT EXISTS printify_variant(
+        sku TEXT PRIMARY KEY,
+        product_id TEXT NOT NULL,
+        variant_id INTEGER NOT NULL,
+        price INTEGER NOT NULL,
+        is_enabled INTEGER NOT NULL,
+        is_available INTEGER NOT NULL,
+        image TEXT NOT NULL,
+        synced_at INTEGER NOT NULL
+    );
     `
 
+	// Carts from before sessions were stored get one when the table is created
+	var had_sessions int
+	row := r.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'sessions'")
+	if err := row.Scan(&had_sessions); err != nil {
+		return err
+	}
+
 	_, err := r.db.Exec(query)
+	if err != nil {
+		return err
+	}
+
+	// Columns added after the tables above were first created
+	columns := [][3]string{
+		{"cart_item", "quantity", "INTEGER NOT NULL DEFAULT 1"},
+		{"cart_item", "unit_price", "INTEGER NOT NULL DEFAULT 0"},
+		{"shopping_cart", "state", "TEXT NOT NULL DEFAULT 'open'"},
+		{"orders", "shipping_priced", "INTEGER NOT NULL DEFAULT 0"},
+		{"orders", "review_reason", "TEXT NOT NULL DEFAULT ''"},
+		{"orders", "refunded", "INTEGER NOT NULL DEFAULT 0"},
+		{"orders", "dispute_status", "TEXT NOT NULL DEFAULT ''"},
+		{"orders", "discount", "INTEGER NOT NULL DEFAULT 0"},
+		{"orders", "promo_code", "TEXT NOT NULL DEFAULT ''"},
+		{"shopping_cart", "promo_code", "TEXT NOT NULL DEFAULT ''"},
+		{"orders", "tax", "INTEGER NOT NULL DEFAULT 0"},
+		{"orders", "shipping_method", "TEXT NOT NULL DEFAULT 'standard'"},
+		{"orders", "phone", "TEXT NOT NULL DEFAULT ''"},
+		{"orders", "submitting_at", "INTEGER NOT NULL DEFAULT 0"},
+	}
+	for _, c := range columns {
+		if err := r.addColumn(c[0], c[1], c[2]); err != nil {
+			return err
+		}
+	}
+
+	if had_sessions == 0 {
+		return r.adoptCartSessions()
+	}
+	return nil
+}
+
+// Add a column to a table created by an earlier version of the schema, if
+// the table doesn't already have it.
+func (r *SQLiteDatabase) addColumn(table string, column string, definition string) error {
+	var count int
+	row := r.db.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column)
+	if err := row.Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	log.Printf("Migrate: Adding column %s to %s\n", column, table)
+	_, err := r.db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
 	return err
 }
 
@@ -50,9 +248,9 @@ func (r *SQLiteDatabase) Migrate() error {
 /**********/
 
 func (r *SQLiteDatabase) CreateCartEntry(session_id string) (*ShoppingCart, error) {
-	var shopping_cart ShoppingCart = ShoppingCart{SessionID: session_id}
+	var shopping_cart ShoppingCart = ShoppingCart{SessionID: session_id, State: CartOpen}
 
-	res, err := r.db.Exec("INSERT INTO shopping_cart(session_id, payment_intent_id) values(?, ?)", shopping_cart.SessionID, "")
+	res, err := r.db.Exec("INSERT INTO shopping_cart(session_id, payment_intent_id, state) values(?, ?, ?)", shopping_cart.SessionID, "", shopping_cart.State)
 	if err != nil {
 		var sqliteErr sqlite3.Error
 		if errors.As(err, &sqliteErr) {
@@ -73,7 +271,11 @@ func (r *SQLiteDatabase) CreateCartEntry(session_id string) (*ShoppingCart, erro
 }
 
 func (r *SQLiteDatabase) CreateItemEntry(item CartItem) (*CartItem, error) {
-	res, err := r.db.Exec("INSERT INTO cart_item(shopping_cart_id, item, size, color) values(?,?,?,?)", item.ShoppingCartID, item.Item, item.Size, item.Color)
+	if item.Quantity < 1 {
+		item.Quantity = 1
+	}
+
+	res, err := r.db.Exec("INSERT INTO cart_item(shopping_cart_id, item, size, color, quantity) values(?,?,?,?,?)", item.ShoppingCartID, item.Item, item.Size, item.Color, item.Quantity)
 	if err != nil {
 		var sqliteErr sqlite3.Error
 		if errors.As(err, &sqliteErr) {
@@ -125,12 +327,41 @@ func (r *SQLiteDatabase) UpdatePaymentIntentID(session_id string, paymentintent_
 	return r.updateCart(shopping_cart.ID, "payment_intent_id", paymentintent_id)
 }
 
-func (r *SQLiteDatabase) UpdateSessionID(session_id string, new_session_id string) error {
-	shopping_cart, err := r.GetCartBySessionID(session_id)
+// Set the number of units of a cart item
+func (r *SQLiteDatabase) UpdateItemQuantity(id int64, quantity int64) error {
+	return r.updateItem(id, "quantity", quantity)
+}
+
+// Lock the price a cart item is charged at, see CartItem.UnitPrice
+func (r *SQLiteDatabase) LockItemPrice(id int64, unit_price int64) error {
+	return r.updateItem(id, "unit_price", unit_price)
+}
+
+func (r *SQLiteDatabase) updateItem(id int64, column string, newval int64) error {
+	res, err := r.db.Exec("UPDATE cart_item SET "+column+" = ? WHERE id = ?", newval, id)
 	if err != nil {
-		return error_messages.ErrNotExists
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return error_messages.ErrUpdateFailed
 	}
-	return r.updateCart(shopping_cart.ID, "session_id", new_session_id)
+
+	return nil
+}
+
+func (r *SQLiteDatabase) UpdateCartState(id int64, state CartState) error {
+	return r.updateCart(id, "state", string(state))
+}
+
+// Apply a promo code to the cart, an empty code removes it
+func (r *SQLiteDatabase) UpdateCartPromoCode(id int64, code string) error {
+	return r.updateCart(id, "promo_code", code)
 }
 
 func (r *SQLiteDatabase) updateCart(id int64, column string, newval string) error {
@@ -162,16 +393,20 @@ func (r *SQLiteDatabase) GetCartBySessionID(session_id string) (*ShoppingCart, e
 
 // Return a user's ShoppingCart struct based on their payment intent id.
 func (r *SQLiteDatabase) GetCartByPaymentIntentID(payment_intent_id string) (*ShoppingCart, error) {
+	// Carts that haven't been checked out don't have one
+	if payment_intent_id == "" {
+		return nil, error_messages.ErrNotExists
+	}
 	return r.getCartByColumn("payment_intent_id", payment_intent_id)
 }
 
 // Return a shopping cart struct based on a specific column
 func (r *SQLiteDatabase) getCartByColumn(col_title string, col_val string) (*ShoppingCart, error) {
-	row := r.db.QueryRow("SELECT * FROM shopping_cart WHERE "+col_title+" = ?", col_val)
+	row := r.db.QueryRow("SELECT id, session_id, payment_intent_id, state, promo_code FROM shopping_cart WHERE "+col_title+" = ?", col_val)
 
 	//fmt.Printf("Retrieving cart where %s == %s\n", col_title, col_val)
 	var shopping_cart ShoppingCart
-	if err := row.Scan(&shopping_cart.ID, &shopping_cart.SessionID, &shopping_cart.PaymentIntentID); err != nil {
+	if err := row.Scan(&shopping_cart.ID, &shopping_cart.SessionID, &shopping_cart.PaymentIntentID, &shopping_cart.State, &shopping_cart.PromoCode); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, error_messages.ErrNotExists
 		}
@@ -196,7 +431,7 @@ func (r *SQLiteDatabase) GetItemsBySessionID(session_id string) ([]CartItem, err
 }
 
 func (r *SQLiteDatabase) getItemsByShoppingCartID(id int64) ([]CartItem, error) {
-	rows, err := r.db.Query("SELECT * FROM cart_item WHERE shopping_cart_id = ?", id)
+	rows, err := r.db.Query("SELECT id, shopping_cart_id, item, size, color, quantity, unit_price FROM cart_item WHERE shopping_cart_id = ?", id)
 	if err != nil {
 		log.Printf("Error in getItemsByShoppingCartID(): %v\n", err)
 		return nil, err
@@ -207,7 +442,7 @@ func (r *SQLiteDatabase) getItemsByShoppingCartID(id int64) ([]CartItem, error)
 	var items []CartItem
 	for rows.Next() {
 		var item CartItem
-		if err := rows.Scan(&item.ID, &item.ShoppingCartID, &item.Item, &item.Size, &item.Color); err != nil {
+		if err := rows.Scan(&item.ID, &item.ShoppingCartID, &item.Item, &item.Size, &item.Color, &item.Quantity, &item.UnitPrice); err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
 				return nil, error_messages.ErrNotExists
 			}
@@ -226,8 +461,22 @@ func (r *SQLiteDatabase) getItemsByShoppingCartID(id int64) ([]CartItem, error)
 	return items, nil
 }
 
+// Return the cart's entry for the same item, size and color as item
+func (r *SQLiteDatabase) GetItem(item CartItem) (*CartItem, error) {
+	items, err := r.getItemsByShoppingCartID(item.ShoppingCartID)
+	if err != nil {
+		return nil, err
+	}
+	for _, cart_item := range items {
+		if cart_item.Item == item.Item && cart_item.Size == item.Size && cart_item.Color == item.Color {
+			return &cart_item, nil
+		}
+	}
+	return nil, error_messages.ErrNotExists
+}
+
 func (r *SQLiteDatabase) AllCarts() ([]ShoppingCart, error) {
-	rows, err := r.db.Query("SELECT * FROM shopping_cart")
+	rows, err := r.db.Query("SELECT id, session_id, payment_intent_id, state, promo_code FROM shopping_cart")
 	if err != nil {
 		return nil, err
 	}
@@ -236,7 +485,7 @@ func (r *SQLiteDatabase) AllCarts() ([]ShoppingCart, error) {
 	var all []ShoppingCart
 	for rows.Next() {
 		var shopping_cart ShoppingCart
-		if err := rows.Scan(&shopping_cart.ID, &shopping_cart.SessionID, &shopping_cart.PaymentIntentID); err != nil {
+		if err := rows.Scan(&shopping_cart.ID, &shopping_cart.SessionID, &shopping_cart.PaymentIntentID, &shopping_cart.State, &shopping_cart.PromoCode); err != nil {
 			return nil, err
 		}
 		all = append(all, shopping_cart)
@@ -0,0 +1,47 @@
+package cart
+
+/* Audit trail of what happened to each order */
+
+import (
+	"log"
+	"time"
+)
+
+type OrderEvent struct {
+	ID        int64
+	OrderID   int64
+	Event     string
+	Detail    string
+	CreatedAt time.Time
+}
+
+// Record an event in the order's audit trail. Failing to record it is logged
+// but doesn't fail whatever the event describes.
+func (r *SQLiteDatabase) AddOrderEvent(order_id int64, event string, detail string) {
+	_, err := r.db.Exec("INSERT INTO order_events(order_id, event, detail, created_at) values(?,?,?,?)",
+		order_id, event, detail, time.Now().Unix())
+	if err != nil {
+		log.Printf("AddOrderEvent: Could not record %s for order %d: %v\n", event, order_id, err)
+	}
+}
+
+// Return the order's audit trail, oldest first
+func (r *SQLiteDatabase) GetOrderEvents(order_id int64) ([]OrderEvent, error) {
+	rows, err := r.db.Query("SELECT id, order_id, event, detail, created_at FROM order_events WHERE order_id = ? ORDER BY id", order_id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []OrderEvent
+	for rows.Next() {
+		var event OrderEvent
+		var created_at int64
+		if err := rows.Scan(&event.ID, &event.OrderID, &event.Event, &event.Detail, &created_at); err != nil {
+			return nil, err
+		}
+		event.CreatedAt = time.Unix(created_at, 0)
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
@@ -0,0 +1,442 @@
+package cart
+
+/* Orders: the priced snapshot of a cart and its fulfillment status */
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"server/error_messages"
+	"time"
+)
+
+type OrderStatus string
+
+const (
+	OrderPendingPayment OrderStatus = "pending_payment"
+	// Paid, but the amount or items didn't match the snapshot. Held until
+	// someone approves, cancels or refunds it.
+	OrderNeedsReview OrderStatus = "needs_review"
+	OrderPaid        OrderStatus = "paid"
+	// Printify rejected the order or couldn't be reached, it can be retried
+	OrderSubmissionFailed OrderStatus = "submission_failed"
+	OrderSubmitted        OrderStatus = "submitted"
+	OrderInProduction     OrderStatus = "in_production"
+	OrderShipped          OrderStatus = "shipped"
+	OrderDelivered        OrderStatus = "delivered"
+	OrderCanceled         OrderStatus = "canceled"
+	OrderRefunded         OrderStatus = "refunded"
+)
+
+// The statuses an order may move to from each status
+var orderTransitions = map[OrderStatus][]OrderStatus{
+	OrderPendingPayment:   {OrderPaid, OrderNeedsReview, OrderCanceled},
+	OrderNeedsReview:      {OrderPaid, OrderCanceled, OrderRefunded},
+	OrderPaid:             {OrderSubmitted, OrderSubmissionFailed, OrderCanceled, OrderRefunded},
+	OrderSubmissionFailed: {OrderSubmitted, OrderCanceled, OrderRefunded},
+	OrderSubmitted:        {OrderInProduction, OrderShipped, OrderCanceled, OrderRefunded},
+	OrderInProduction:     {OrderShipped, OrderRefunded},
+	OrderShipped:          {OrderDelivered, OrderRefunded},
+	OrderDelivered:        {OrderRefunded},
+	OrderCanceled:         {},
+	OrderRefunded:         {},
+}
+
+func (s OrderStatus) CanTransition(to OrderStatus) bool {
+	for _, allowed := range orderTransitions[s] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+type Order struct {
+	ID              int64
+	ShoppingCartID  int64
+	PaymentIntentID string
+	// Zero padded order_label, set when the order is submitted to Printify
+	Label    string
+	Status   OrderStatus
+	Subtotal int64
+	Shipping int64
+	// Printify shipping method the customer chose, ex: standard or express
+	ShippingMethod string
+	// Taken off the subtotal and shipping by PromoCode
+	Discount  int64
+	PromoCode string
+	// Sales tax for the shipping address, see package tax
+	Tax   int64
+	Total int64
+	// Whether Shipping was quoted for the snapshot's address and items
+	ShippingPriced bool
+	ReviewReason   string
+	// Amount refunded through Stripe so far
+	Refunded int64
+	// Status of the latest Stripe dispute, empty if the payment wasn't disputed
+	DisputeStatus   string
+	Customer        Customer
+	PrintifyOrderID string
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+	Items           []OrderItem
+}
+
+type Customer struct {
+	Name       string
+	Email      string
+	Phone      string // Starts with + if it has a country code
+	Line1      string
+	Line2      string
+	City       string
+	State      string
+	PostalCode string
+	Country    string
+}
+
+type OrderItem struct {
+	ID        int64
+	OrderID   int64
+	Item      string
+	Size      string
+	Color     string
+	Quantity  int64
+	UnitPrice int64
+	SKU       string
+}
+
+// Snapshot cart items into order items at their current price
+func NewOrderItems(items []CartItem) ([]OrderItem, error) {
+	order_items := []OrderItem{}
+	for _, item := range AggregateItems(items) {
+		price, err := item.Price()
+		if err != nil {
+			return nil, err
+		}
+		sku, err := item.GetSKU()
+		if err != nil {
+			return nil, err
+		}
+		order_items = append(order_items, OrderItem{
+			Item:      item.Item,
+			Size:      item.Size,
+			Color:     item.Color,
+			Quantity:  item.Quantity,
+			UnitPrice: price,
+			SKU:       sku,
+		})
+	}
+	return order_items, nil
+}
+
+// The order's items as cart items, for building Printify submissions
+func (o *Order) CartItems() []CartItem {
+	items := []CartItem{}
+	for _, order_item := range o.Items {
+		items = append(items, CartItem{
+			ShoppingCartID: o.ShoppingCartID,
+			Item:           order_item.Item,
+			Size:           order_item.Size,
+			Color:          order_item.Color,
+			Quantity:       order_item.Quantity,
+			UnitPrice:      order_item.UnitPrice,
+		})
+	}
+	return items
+}
+
+/**********/
+/* CREATE */
+/**********/
+
+// Create the order for a PaymentIntent, or replace the items and amounts of
+// its existing order while it is still awaiting payment.
+func (r *SQLiteDatabase) SaveOrderSnapshot(order *Order) (*Order, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().Unix()
+
+	var id int64
+	var status OrderStatus
+	row := tx.QueryRow("SELECT id, status FROM orders WHERE payment_intent_id = ?", order.PaymentIntentID)
+	err = row.Scan(&id, &status)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		res, err := tx.Exec("INSERT INTO orders(shopping_cart_id, payment_intent_id, status, subtotal, shipping, discount, promo_code, tax, total, shipping_priced, shipping_method, created_at, updated_at) values(?,?,?,?,?,?,?,?,?,?,?,?,?)",
+			order.ShoppingCartID, order.PaymentIntentID, OrderPendingPayment, order.Subtotal, order.Shipping, order.Discount, order.PromoCode, order.Tax, order.Total, order.ShippingPriced, order.ShippingMethod, now, now)
+		if err != nil {
+			return nil, err
+		}
+		if id, err = res.LastInsertId(); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	case status != OrderPendingPayment:
+		log.Printf("SaveOrderSnapshot: Order %d for %s is already %s\n", id, order.PaymentIntentID, status)
+		return nil, error_messages.ErrInvalidTransition
+	default:
+		_, err := tx.Exec("UPDATE orders SET shopping_cart_id = ?, subtotal = ?, shipping = ?, discount = ?, promo_code = ?, tax = ?, total = ?, shipping_priced = ?, shipping_method = ?, updated_at = ? WHERE id = ?",
+			order.ShoppingCartID, order.Subtotal, order.Shipping, order.Discount, order.PromoCode, order.Tax, order.Total, order.ShippingPriced, order.ShippingMethod, now, id)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec("DELETE FROM order_items WHERE order_id = ?", id); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, item := range order.Items {
+		_, err := tx.Exec("INSERT INTO order_items(order_id, item, size, color, quantity, unit_price, sku) values(?,?,?,?,?,?,?)",
+			id, item.Item, item.Size, item.Color, item.Quantity, item.UnitPrice, item.SKU)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return r.GetOrderByID(id)
+}
+
+/**********/
+/* UPDATE */
+/**********/
+
+// Move an order to a new status if the transition is allowed from the status
+// it is currently in.
+func (r *SQLiteDatabase) UpdateOrderStatus(id int64, to OrderStatus) error {
+	order, err := r.GetOrderByID(id)
+	if err != nil {
+		return err
+	}
+
+	if !order.Status.CanTransition(to) {
+		log.Printf("UpdateOrderStatus: Order %d can not move from %s to %s\n", id, order.Status, to)
+		return error_messages.ErrInvalidTransition
+	}
+
+	// Only update if nothing else changed the status in the meantime
+	res, err := r.db.Exec("UPDATE orders SET status = ?, updated_at = ? WHERE id = ? AND status = ?", to, time.Now().Unix(), id, order.Status)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return error_messages.ErrUpdateFailed
+	}
+
+	log.Printf("Order %d: %s -> %s\n", id, order.Status, to)
+	r.AddOrderEvent(id, "status", string(order.Status)+" -> "+string(to))
+	return nil
+}
+
+// How long a claimed submission keeps the order from being submitted again,
+// in case the process that claimed it exited mid-request
+const submissionClaimTimeout = 10 * time.Minute
+
+// Claim a paid order for submitting it to Printify, so its status can't be
+// checked by one submission while another one is running. Returns
+// ErrInvalidTransition if the order can no longer be submitted, or
+// ErrInProgress if it is already being submitted.
+func (r *SQLiteDatabase) ClaimOrderSubmission(id int64) error {
+	now := time.Now()
+	res, err := r.db.Exec("UPDATE orders SET submitting_at = ?, updated_at = ? WHERE id = ? AND status IN (?, ?) AND submitting_at < ?",
+		now.Unix(), now.Unix(), id, OrderPaid, OrderSubmissionFailed, now.Add(-submissionClaimTimeout).Unix())
+	if err := checkOrderUpdate(res, err); err != error_messages.ErrUpdateFailed {
+		return err
+	}
+
+	order, err := r.GetOrderByID(id)
+	if err != nil {
+		return err
+	}
+	if order.Status != OrderPaid && order.Status != OrderSubmissionFailed {
+		return error_messages.ErrInvalidTransition
+	}
+	return error_messages.ErrInProgress
+}
+
+func (r *SQLiteDatabase) ReleaseOrderSubmission(id int64) error {
+	return r.updateOrder(id, "submitting_at", 0)
+}
+
+func (r *SQLiteDatabase) UpdateOrderCustomer(id int64, customer Customer) error {
+	res, err := r.db.Exec("UPDATE orders SET name = ?, email = ?, phone = ?, line1 = ?, line2 = ?, city = ?, state = ?, postal_code = ?, country = ?, updated_at = ? WHERE id = ?",
+		customer.Name, customer.Email, customer.Phone, customer.Line1, customer.Line2, customer.City, customer.State, customer.PostalCode, customer.Country, time.Now().Unix(), id)
+	return checkOrderUpdate(res, err)
+}
+
+func (r *SQLiteDatabase) UpdateOrderLabel(id int64, label string) error {
+	return r.updateOrder(id, "label", label)
+}
+
+func (r *SQLiteDatabase) UpdateOrderReviewReason(id int64, reason string) error {
+	return r.updateOrder(id, "review_reason", reason)
+}
+
+func (r *SQLiteDatabase) UpdateOrderRefunded(id int64, refunded int64) error {
+	return r.updateOrder(id, "refunded", refunded)
+}
+
+func (r *SQLiteDatabase) UpdateOrderDisputeStatus(id int64, dispute_status string) error {
+	return r.updateOrder(id, "dispute_status", dispute_status)
+}
+
+func (r *SQLiteDatabase) UpdatePrintifyOrderID(id int64, printify_order_id string) error {
+	return r.updateOrder(id, "printify_order_id", printify_order_id)
+}
+
+func (r *SQLiteDatabase) updateOrder(id int64, column string, newval interface{}) error {
+	res, err := r.db.Exec("UPDATE orders SET "+column+" = ?, updated_at = ? WHERE id = ?", newval, time.Now().Unix(), id)
+	return checkOrderUpdate(res, err)
+}
+
+func checkOrderUpdate(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return error_messages.ErrUpdateFailed
+	}
+
+	return nil
+}
+
+/*******/
+/* GET */
+/*******/
+
+const orderColumns = "id, shopping_cart_id, payment_intent_id, label, status, subtotal, shipping, total, name, email, line1, line2, city, state, postal_code, country, printify_order_id, shipping_priced, review_reason, refunded, dispute_status, discount, promo_code, tax, shipping_method, phone, created_at, updated_at"
+
+func (r *SQLiteDatabase) GetOrderByID(id int64) (*Order, error) {
+	return r.getOrderByColumn("id", id)
+}
+
+func (r *SQLiteDatabase) GetOrderByPaymentIntentID(payment_intent_id string) (*Order, error) {
+	return r.getOrderByColumn("payment_intent_id", payment_intent_id)
+}
+
+func (r *SQLiteDatabase) GetOrderByPrintifyOrderID(printify_order_id string) (*Order, error) {
+	// Orders that were never submitted don't have one
+	if printify_order_id == "" {
+		return nil, error_messages.ErrNotExists
+	}
+	return r.getOrderByColumn("printify_order_id", printify_order_id)
+}
+
+func (r *SQLiteDatabase) GetOrderByLabel(label string) (*Order, error) {
+	return r.getOrderByColumn("label", label)
+}
+
+// Return an order and its items based on a specific column
+func (r *SQLiteDatabase) getOrderByColumn(col_title string, col_val interface{}) (*Order, error) {
+	row := r.db.QueryRow("SELECT "+orderColumns+" FROM orders WHERE "+col_title+" = ?", col_val)
+
+	order, err := scanOrder(row)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, error_messages.ErrNotExists
+		}
+		return nil, err
+	}
+
+	order.Items, err = r.getOrderItems(order.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return order, nil
+}
+
+// Return every order in one of the given statuses, oldest first
+func (r *SQLiteDatabase) GetOrdersByStatus(statuses ...OrderStatus) ([]Order, error) {
+	var orders []Order
+	for _, status := range statuses {
+		rows, err := r.db.Query("SELECT "+orderColumns+" FROM orders WHERE status = ? ORDER BY id", status)
+		if err != nil {
+			return nil, err
+		}
+
+		for rows.Next() {
+			order, err := scanOrder(rows)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			orders = append(orders, *order)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range orders {
+		items, err := r.getOrderItems(orders[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		orders[i].Items = items
+	}
+
+	return orders, nil
+}
+
+func (r *SQLiteDatabase) getOrderItems(order_id int64) ([]OrderItem, error) {
+	rows, err := r.db.Query("SELECT id, order_id, item, size, color, quantity, unit_price, sku FROM order_items WHERE order_id = ? ORDER BY id", order_id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []OrderItem
+	for rows.Next() {
+		var item OrderItem
+		if err := rows.Scan(&item.ID, &item.OrderID, &item.Item, &item.Size, &item.Color, &item.Quantity, &item.UnitPrice, &item.SKU); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanOrder(row rowScanner) (*Order, error) {
+	var order Order
+	var shopping_cart_id sql.NullInt64
+	var created_at, updated_at int64
+	err := row.Scan(&order.ID, &shopping_cart_id, &order.PaymentIntentID, &order.Label, &order.Status,
+		&order.Subtotal, &order.Shipping, &order.Total,
+		&order.Customer.Name, &order.Customer.Email, &order.Customer.Line1, &order.Customer.Line2,
+		&order.Customer.City, &order.Customer.State, &order.Customer.PostalCode, &order.Customer.Country,
+		&order.PrintifyOrderID, &order.ShippingPriced, &order.ReviewReason, &order.Refunded, &order.DisputeStatus, &order.Discount, &order.PromoCode, &order.Tax, &order.ShippingMethod, &order.Customer.Phone, &created_at, &updated_at)
+	if err != nil {
+		return nil, err
+	}
+	order.ShoppingCartID = shopping_cart_id.Int64
+	order.CreatedAt = time.Unix(created_at, 0)
+	order.UpdatedAt = time.Unix(updated_at, 0)
+	return &order, nil
+}
@@ -0,0 +1,45 @@
+package cart
+
+import "testing"
+
+func TestOrderStatusCanTransition(t *testing.T) {
+	tests := []struct {
+		from OrderStatus
+		to   OrderStatus
+		want bool
+	}{
+		{OrderPendingPayment, OrderPaid, true},
+		{OrderPendingPayment, OrderNeedsReview, true},
+		{OrderPendingPayment, OrderCanceled, true},
+		{OrderPendingPayment, OrderSubmitted, false},
+		{OrderPendingPayment, OrderRefunded, false},
+		{OrderNeedsReview, OrderPaid, true},
+		{OrderNeedsReview, OrderSubmitted, false},
+		{OrderPaid, OrderSubmitted, true},
+		{OrderPaid, OrderSubmissionFailed, true},
+		{OrderPaid, OrderRefunded, true},
+		{OrderPaid, OrderShipped, false},
+		{OrderSubmissionFailed, OrderSubmitted, true},
+		{OrderSubmissionFailed, OrderPaid, false},
+		{OrderSubmitted, OrderInProduction, true},
+		{OrderSubmitted, OrderShipped, true},
+		{OrderSubmitted, OrderPaid, false},
+		{OrderInProduction, OrderShipped, true},
+		{OrderInProduction, OrderCanceled, false},
+		{OrderShipped, OrderDelivered, true},
+		{OrderShipped, OrderInProduction, false},
+		{OrderDelivered, OrderRefunded, true},
+		{OrderDelivered, OrderShipped, false},
+		{OrderCanceled, OrderPaid, false},
+		{OrderCanceled, OrderRefunded, false},
+		{OrderRefunded, OrderCanceled, false},
+		{OrderPaid, OrderPaid, false},
+		{OrderStatus("unknown"), OrderPaid, false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.from.CanTransition(tt.to); got != tt.want {
+			t.Errorf("%s.CanTransition(%s) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
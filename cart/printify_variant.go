@@ -0,0 +1,50 @@
+package cart
+
+/* Storage for the Printify variants synced by external.SyncCatalog */
+
+import (
+	"server/catalog"
+	"time"
+)
+
+// Replace every stored Printify variant with the result of the latest sync.
+func (r *SQLiteDatabase) ReplacePrintifyVariants(variants []catalog.PrintifyVariant) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM printify_variant"); err != nil {
+		return err
+	}
+
+	synced_at := time.Now().Unix()
+	for _, v := range variants {
+		_, err := tx.Exec("INSERT INTO printify_variant(sku, product_id, variant_id, price, is_enabled, is_available, image, synced_at) values(?,?,?,?,?,?,?,?)",
+			v.SKU, v.ProductID, v.VariantID, v.Price, v.IsEnabled, v.IsAvailable, v.Image, synced_at)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (r *SQLiteDatabase) AllPrintifyVariants() ([]catalog.PrintifyVariant, error) {
+	rows, err := r.db.Query("SELECT sku, product_id, variant_id, price, is_enabled, is_available, image FROM printify_variant")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var all []catalog.PrintifyVariant
+	for rows.Next() {
+		var v catalog.PrintifyVariant
+		if err := rows.Scan(&v.SKU, &v.ProductID, &v.VariantID, &v.Price, &v.IsEnabled, &v.IsAvailable, &v.Image); err != nil {
+			return nil, err
+		}
+		all = append(all, v)
+	}
+	return all, rows.Err()
+}
@@ -0,0 +1,386 @@
+package cart
+
+/* Promo codes: what they take off a cart and when they may be used */
+
+import (
+	"database/sql"
+	"errors"
+	"server/error_messages"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+type PromoKind string
+
+const (
+	// Amount is a percentage off the items in scope
+	PromoPercent PromoKind = "percent"
+	// Amount is cents off the items in scope
+	PromoFixed        PromoKind = "fixed"
+	PromoFreeShipping PromoKind = "free_shipping"
+)
+
+type PromoCode struct {
+	Code   string    `json:"code"`
+	Kind   PromoKind `json:"kind"`
+	Amount int64     `json:"amount"`
+	// Catalog item id the discount is limited to, empty for the whole cart
+	Item        string `json:"item,omitempty"`
+	MinSubtotal int64  `json:"min_subtotal,omitempty"`
+	// Zero times leave the code open ended
+	StartsAt time.Time `json:"starts_at,omitempty"`
+	EndsAt   time.Time `json:"ends_at,omitempty"`
+	// Zero for unlimited uses
+	MaxUses      int64 `json:"max_uses,omitempty"`
+	Uses         int64 `json:"uses"`
+	OncePerEmail bool  `json:"once_per_email,omitempty"`
+}
+
+// Smallest amount Stripe charges in USD
+const minCharge = 50
+
+// What a cart is charged
+type Amounts struct {
+	Subtotal int64
+	Shipping int64
+	// The shipping method Shipping was quoted for, empty means standard
+	ShippingMethod string
+	// Includes ShippingDiscount
+	Discount         int64
+	ShippingDiscount int64
+	PromoCode        string
+	// Catalog item the discount was limited to, empty for the whole cart
+	DiscountItem string
+	Tax          int64
+	Total        int64
+}
+
+// Codes are matched case insensitively
+func NormalizePromoCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+func (p *PromoCode) Validate() error {
+	switch {
+	case p.Code == "" || p.Code != NormalizePromoCode(p.Code):
+		return errors.New("code must be non-empty and upper case")
+	case p.Kind == PromoPercent && (p.Amount < 1 || p.Amount > 100):
+		return errors.New("percent amount must be between 1 and 100")
+	case p.Kind == PromoFixed && p.Amount < 1:
+		return errors.New("fixed amount must be positive")
+	case p.Kind != PromoPercent && p.Kind != PromoFixed && p.Kind != PromoFreeShipping:
+		return errors.New("kind must be percent, fixed or free_shipping")
+	case !p.EndsAt.IsZero() && p.EndsAt.Before(p.StartsAt):
+		return errors.New("ends_at is before starts_at")
+	}
+	return nil
+}
+
+// Check whether the code may be used on a cart with this subtotal right now
+func (p *PromoCode) Check(subtotal int64, now time.Time) error {
+	switch {
+	case !p.StartsAt.IsZero() && now.Before(p.StartsAt):
+		return error_messages.ErrPromoInactive
+	case !p.EndsAt.IsZero() && !now.Before(p.EndsAt):
+		return error_messages.ErrPromoInactive
+	case p.MaxUses > 0 && p.Uses >= p.MaxUses:
+		return error_messages.ErrPromoUsedUp
+	case subtotal < p.MinSubtotal:
+		return error_messages.ErrPromoMinimum
+	}
+	return nil
+}
+
+// The amount the code takes off the items and shipping. Shipping isn't known
+// until the customer enters their address, so free shipping is worth nothing
+// before that.
+func (p *PromoCode) Discount(items []CartItem, shipping int64) (int64, error) {
+	if p.Kind == PromoFreeShipping {
+		return shipping, nil
+	}
+
+	var in_scope int64 = 0
+	for _, item := range items {
+		if p.Item != "" && item.Item != p.Item {
+			continue
+		}
+		price, err := item.Price()
+		if err != nil {
+			return 0, err
+		}
+		in_scope += price * item.Quantity
+	}
+
+	if in_scope == 0 {
+		return 0, error_messages.ErrPromoNotApplicable
+	}
+
+	if p.Kind == PromoPercent {
+		return in_scope * p.Amount / 100, nil
+	}
+	if p.Amount > in_scope {
+		return in_scope, nil
+	}
+	return p.Amount, nil
+}
+
+// Price the items with the promo code applied. email may be empty when it isn't
+// known yet. If the code can't be used the amounts are returned without it,
+// along with the reason.
+func CartAmounts(items []CartItem, shipping int64, promo_code string, email string) (*Amounts, error) {
+	amounts := &Amounts{Shipping: shipping}
+	for _, item := range items {
+		price, err := item.Price()
+		if err != nil {
+			return nil, err
+		}
+		amounts.Subtotal += price * item.Quantity
+	}
+	amounts.Total = amounts.Subtotal + amounts.Shipping
+
+	if promo_code == "" {
+		return amounts, nil
+	}
+
+	promo, err := usablePromoCode(amounts.Subtotal, promo_code, email)
+	if err != nil {
+		return amounts, err
+	}
+	discount, err := promo.Discount(items, shipping)
+	if err != nil {
+		return amounts, err
+	}
+
+	// Stripe won't charge less than 50 cents
+	if amounts.Total-discount < minCharge {
+		discount = amounts.Total - minCharge
+		if discount < 0 {
+			discount = 0
+		}
+	}
+
+	amounts.Discount = discount
+	if promo.Kind == PromoFreeShipping {
+		amounts.ShippingDiscount = discount
+	} else {
+		amounts.DiscountItem = promo.Item
+	}
+	amounts.PromoCode = promo_code
+	amounts.Total -= discount
+	return amounts, nil
+}
+
+// The part of the discount on items taken off each of them, in the order of
+// items. The discount is spread over the items it applies to in proportion to
+// their price, and the last of them takes the remainder left by rounding.
+func (a *Amounts) LineDiscounts(items []CartItem) ([]int64, error) {
+	discounts := make([]int64, len(items))
+	item_discount := a.Discount - a.ShippingDiscount
+	if item_discount <= 0 {
+		return discounts, nil
+	}
+
+	lines := make([]int64, len(items))
+	var in_scope int64 = 0
+	last := -1
+	for i, item := range items {
+		if a.DiscountItem != "" && item.Item != a.DiscountItem {
+			continue
+		}
+		price, err := item.Price()
+		if err != nil {
+			return nil, err
+		}
+		lines[i] = price * item.Quantity
+		in_scope += lines[i]
+		last = i
+	}
+	if in_scope == 0 {
+		return discounts, nil
+	}
+
+	remaining := item_discount
+	for i := range items {
+		if i == last {
+			discounts[i] = remaining
+			break
+		}
+		discounts[i] = item_discount * lines[i] / in_scope
+		remaining -= discounts[i]
+	}
+	return discounts, nil
+}
+
+func usablePromoCode(subtotal int64, promo_code string, email string) (*PromoCode, error) {
+	promo, err := Repo.GetPromoCode(promo_code)
+	if err == error_messages.ErrNotExists {
+		return nil, error_messages.ErrPromoInvalid
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := promo.Check(subtotal, time.Now()); err != nil {
+		return nil, err
+	}
+
+	if promo.OncePerEmail && email != "" {
+		used, err := Repo.PromoRedeemedBy(promo.Code, email)
+		if err != nil {
+			return nil, err
+		}
+		if used {
+			return nil, error_messages.ErrPromoAlreadyUsed
+		}
+	}
+
+	return promo, nil
+}
+
+// Whether err means the promo code can't be used, rather than that it couldn't
+// be looked up
+func IsPromoError(err error) bool {
+	switch err {
+	case error_messages.ErrPromoInvalid, error_messages.ErrPromoInactive, error_messages.ErrPromoUsedUp,
+		error_messages.ErrPromoMinimum, error_messages.ErrPromoNotApplicable, error_messages.ErrPromoAlreadyUsed:
+		return true
+	}
+	return false
+}
+
+/**********/
+/* CREATE */
+/**********/
+
+func (r *SQLiteDatabase) CreatePromoCode(promo PromoCode) error {
+	_, err := r.db.Exec("INSERT INTO promo_codes(code, kind, amount, item, min_subtotal, starts_at, ends_at, max_uses, once_per_email, created_at) values(?,?,?,?,?,?,?,?,?,?)",
+		promo.Code, promo.Kind, promo.Amount, promo.Item, promo.MinSubtotal, unixOrZero(promo.StartsAt), unixOrZero(promo.EndsAt),
+		promo.MaxUses, promo.OncePerEmail, time.Now().Unix())
+	if err != nil {
+		var sqliteErr sqlite3.Error
+		if errors.As(err, &sqliteErr) {
+			if errors.Is(sqliteErr.ExtendedCode, sqlite3.ErrConstraintPrimaryKey) {
+				return error_messages.ErrDuplicate
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// Record that an order used its promo code and count it towards the code's
+// uses. Recording the same order again does nothing. With enforce_limits the
+// code's max_uses and once_per_email are checked in the same transaction, so
+// two orders priced with its last use can't both redeem it: the loser gets
+// ErrPromoUsedUp or ErrPromoAlreadyUsed and nothing is recorded.
+func (r *SQLiteDatabase) RedeemPromoCode(order *Order, enforce_limits bool) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	email := strings.ToLower(strings.TrimSpace(order.Customer.Email))
+	res, err := tx.Exec("INSERT INTO promo_redemptions(code, order_id, email, discount, created_at) values(?,?,?,?,?) ON CONFLICT(order_id) DO NOTHING",
+		order.PromoCode, order.ID, email, order.Discount, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if inserted == 0 {
+		return error_messages.ErrDuplicate
+	}
+
+	if !enforce_limits {
+		if _, err := tx.Exec("UPDATE promo_codes SET uses = uses + 1 WHERE code = ?", order.PromoCode); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+
+	if email != "" {
+		var used int
+		row := tx.QueryRow("SELECT COUNT(*) FROM promo_redemptions JOIN promo_codes USING(code) WHERE code = ? AND email = ? AND order_id != ? AND once_per_email",
+			order.PromoCode, email, order.ID)
+		if err := row.Scan(&used); err != nil {
+			return err
+		}
+		if used > 0 {
+			return error_messages.ErrPromoAlreadyUsed
+		}
+	}
+
+	res, err = tx.Exec("UPDATE promo_codes SET uses = uses + 1 WHERE code = ? AND (max_uses = 0 OR uses < max_uses)", order.PromoCode)
+	if err != nil {
+		return err
+	}
+	if updated, err := res.RowsAffected(); err != nil {
+		return err
+	} else if updated == 0 {
+		return error_messages.ErrPromoUsedUp
+	}
+
+	return tx.Commit()
+}
+
+/*******/
+/* GET */
+/*******/
+
+const promoColumns = "code, kind, amount, item, min_subtotal, starts_at, ends_at, max_uses, uses, once_per_email"
+
+func (r *SQLiteDatabase) GetPromoCode(code string) (*PromoCode, error) {
+	row := r.db.QueryRow("SELECT "+promoColumns+" FROM promo_codes WHERE code = ?", NormalizePromoCode(code))
+	promo, err := scanPromoCode(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, error_messages.ErrNotExists
+	}
+	return promo, err
+}
+
+func (r *SQLiteDatabase) AllPromoCodes() ([]PromoCode, error) {
+	rows, err := r.db.Query("SELECT " + promoColumns + " FROM promo_codes ORDER BY created_at")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var promos []PromoCode
+	for rows.Next() {
+		promo, err := scanPromoCode(rows)
+		if err != nil {
+			return nil, err
+		}
+		promos = append(promos, *promo)
+	}
+	return promos, rows.Err()
+}
+
+// Whether an order paid with this email already used the code
+func (r *SQLiteDatabase) PromoRedeemedBy(code string, email string) (bool, error) {
+	var count int
+	row := r.db.QueryRow("SELECT COUNT(*) FROM promo_redemptions WHERE code = ? AND email = ?",
+		NormalizePromoCode(code), strings.ToLower(strings.TrimSpace(email)))
+	if err := row.Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func scanPromoCode(row rowScanner) (*PromoCode, error) {
+	var promo PromoCode
+	var starts_at, ends_at int64
+	err := row.Scan(&promo.Code, &promo.Kind, &promo.Amount, &promo.Item, &promo.MinSubtotal,
+		&starts_at, &ends_at, &promo.MaxUses, &promo.Uses, &promo.OncePerEmail)
+	if err != nil {
+		return nil, err
+	}
+	promo.StartsAt = timeOrZero(starts_at)
+	promo.EndsAt = timeOrZero(ends_at)
+	return &promo, nil
+}
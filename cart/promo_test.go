@@ -0,0 +1,263 @@
+package cart
+
+import (
+	"database/sql"
+	"path/filepath"
+	"server/error_messages"
+	"testing"
+	"time"
+)
+
+// Point Repo at an empty database for the length of the test
+func useTestDatabase(t *testing.T) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	previous := Repo
+	Repo = NewSQLiteDatabase(db)
+	t.Cleanup(func() { Repo = previous })
+
+	if err := Repo.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCartAmounts(t *testing.T) {
+	useTestDatabase(t)
+
+	now := time.Now()
+	promos := []PromoCode{
+		{Code: "TENOFF", Kind: PromoPercent, Amount: 10},
+		{Code: "FIVE", Kind: PromoFixed, Amount: 500},
+		{Code: "HUGE", Kind: PromoFixed, Amount: 100000},
+		{Code: "SHIPFREE", Kind: PromoFreeShipping},
+		{Code: "MUGS", Kind: PromoPercent, Amount: 50, Item: "mug"},
+		{Code: "BIGCART", Kind: PromoFixed, Amount: 500, MinSubtotal: 10000},
+		{Code: "EXPIRED", Kind: PromoFixed, Amount: 500, EndsAt: now.Add(-time.Hour)},
+		{Code: "LATER", Kind: PromoFixed, Amount: 500, StartsAt: now.Add(time.Hour)},
+		{Code: "ONCE", Kind: PromoFixed, Amount: 500, OncePerEmail: true},
+	}
+	for _, promo := range promos {
+		if err := Repo.CreatePromoCode(promo); err != nil {
+			t.Fatal(err)
+		}
+	}
+	redeemed := &Order{ID: 1, PromoCode: "ONCE", Discount: 500, Customer: Customer{Email: "used@example.com"}}
+	if err := Repo.RedeemPromoCode(redeemed, true); err != nil {
+		t.Fatal(err)
+	}
+
+	items := []CartItem{
+		{Item: "shirt", Quantity: 2, UnitPrice: 2000},
+		{Item: "mug", Quantity: 1, UnitPrice: 1200},
+	}
+
+	tests := []struct {
+		name     string
+		items    []CartItem
+		shipping int64
+		code     string
+		email    string
+		want     Amounts
+		err      error
+	}{
+		{
+			name:     "no promo",
+			items:    items,
+			shipping: 500,
+			want:     Amounts{Subtotal: 5200, Shipping: 500, Total: 5700},
+		},
+		{
+			name:     "percent off",
+			items:    items,
+			shipping: 500,
+			code:     "TENOFF",
+			want:     Amounts{Subtotal: 5200, Shipping: 500, Discount: 520, PromoCode: "TENOFF", Total: 5180},
+		},
+		{
+			name:  "fixed off",
+			items: items,
+			code:  "FIVE",
+			want:  Amounts{Subtotal: 5200, Discount: 500, PromoCode: "FIVE", Total: 4700},
+		},
+		{
+			name:  "fixed off is limited to the items",
+			items: items,
+			code:  "HUGE",
+			want:  Amounts{Subtotal: 5200, Discount: 5150, PromoCode: "HUGE", Total: minCharge},
+		},
+		{
+			name:     "free shipping",
+			items:    items,
+			shipping: 650,
+			code:     "SHIPFREE",
+			want:     Amounts{Subtotal: 5200, Shipping: 650, Discount: 650, ShippingDiscount: 650, PromoCode: "SHIPFREE", Total: 5200},
+		},
+		{
+			name:  "free shipping before shipping is known",
+			items: items,
+			code:  "SHIPFREE",
+			want:  Amounts{Subtotal: 5200, PromoCode: "SHIPFREE", Total: 5200},
+		},
+		{
+			name:  "limited to one item",
+			items: items,
+			code:  "MUGS",
+			want:  Amounts{Subtotal: 5200, Discount: 600, PromoCode: "MUGS", DiscountItem: "mug", Total: 4600},
+		},
+		{
+			name:  "item not in cart",
+			items: items[:1],
+			code:  "MUGS",
+			want:  Amounts{Subtotal: 4000, Total: 4000},
+			err:   error_messages.ErrPromoNotApplicable,
+		},
+		{
+			name:  "codes are matched case insensitively",
+			items: items,
+			code:  "five",
+			want:  Amounts{Subtotal: 5200, Discount: 500, PromoCode: "five", Total: 4700},
+		},
+		{
+			name:  "unknown code",
+			items: items,
+			code:  "NOPE",
+			want:  Amounts{Subtotal: 5200, Total: 5200},
+			err:   error_messages.ErrPromoInvalid,
+		},
+		{
+			name:  "below minimum subtotal",
+			items: items,
+			code:  "BIGCART",
+			want:  Amounts{Subtotal: 5200, Total: 5200},
+			err:   error_messages.ErrPromoMinimum,
+		},
+		{
+			name:  "expired",
+			items: items,
+			code:  "EXPIRED",
+			want:  Amounts{Subtotal: 5200, Total: 5200},
+			err:   error_messages.ErrPromoInactive,
+		},
+		{
+			name:  "not started",
+			items: items,
+			code:  "LATER",
+			want:  Amounts{Subtotal: 5200, Total: 5200},
+			err:   error_messages.ErrPromoInactive,
+		},
+		{
+			name:  "once per email, new customer",
+			items: items,
+			code:  "ONCE",
+			email: "new@example.com",
+			want:  Amounts{Subtotal: 5200, Discount: 500, PromoCode: "ONCE", Total: 4700},
+		},
+		{
+			name:  "once per email, already used",
+			items: items,
+			code:  "ONCE",
+			email: "used@example.com",
+			want:  Amounts{Subtotal: 5200, Total: 5200},
+			err:   error_messages.ErrPromoAlreadyUsed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := CartAmounts(tt.items, tt.shipping, tt.code, tt.email)
+			if err != tt.err {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if *got != tt.want {
+				t.Errorf("got %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedeemPromoCode(t *testing.T) {
+	useTestDatabase(t)
+
+	if err := Repo.CreatePromoCode(PromoCode{Code: "LAST", Kind: PromoFixed, Amount: 500, MaxUses: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Repo.CreatePromoCode(PromoCode{Code: "ONCE", Kind: PromoFixed, Amount: 500, OncePerEmail: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		order   Order
+		enforce bool
+		err     error
+	}{
+		{"first use", Order{ID: 1, PromoCode: "LAST"}, true, nil},
+		{"same order again", Order{ID: 1, PromoCode: "LAST"}, true, error_messages.ErrDuplicate},
+		{"used up", Order{ID: 2, PromoCode: "LAST"}, true, error_messages.ErrPromoUsedUp},
+		{"used up without limits", Order{ID: 3, PromoCode: "LAST"}, false, nil},
+		{"first use by email", Order{ID: 4, PromoCode: "ONCE", Customer: Customer{Email: "a@example.com"}}, true, nil},
+		{"email matched case insensitively", Order{ID: 5, PromoCode: "ONCE", Customer: Customer{Email: " A@Example.com"}}, true, error_messages.ErrPromoAlreadyUsed},
+		{"other email", Order{ID: 6, PromoCode: "ONCE", Customer: Customer{Email: "b@example.com"}}, true, nil},
+		{"same email without limits", Order{ID: 7, PromoCode: "ONCE", Customer: Customer{Email: "b@example.com"}}, false, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Repo.RedeemPromoCode(&tt.order, tt.enforce); err != tt.err {
+				t.Errorf("err = %v, want %v", err, tt.err)
+			}
+		})
+	}
+
+	for code, want := range map[string]int64{"LAST": 2, "ONCE": 3} {
+		promo, err := Repo.GetPromoCode(code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if promo.Uses != want {
+			t.Errorf("%s uses = %d, want %d", code, promo.Uses, want)
+		}
+	}
+}
+
+func TestLineDiscounts(t *testing.T) {
+	items := []CartItem{
+		{Item: "shirt", Quantity: 2, UnitPrice: 1999},
+		{Item: "mug", Quantity: 1, UnitPrice: 1200},
+		{Item: "shirt", Quantity: 1, UnitPrice: 2500},
+	}
+
+	tests := []struct {
+		name    string
+		amounts Amounts
+		want    []int64
+	}{
+		{"no discount", Amounts{}, []int64{0, 0, 0}},
+		{"shipping discount only", Amounts{Discount: 500, ShippingDiscount: 500}, []int64{0, 0, 0}},
+		{"spread by price", Amounts{Discount: 1000}, []int64{519, 155, 326}},
+		{"item discount next to shipping discount", Amounts{Discount: 1500, ShippingDiscount: 500}, []int64{519, 155, 326}},
+		{"limited to one item", Amounts{Discount: 650, DiscountItem: "shirt"}, []int64{399, 0, 251}},
+		{"last line in scope takes the remainder", Amounts{Discount: 100, DiscountItem: "shirt"}, []int64{61, 0, 39}},
+		{"item not in cart", Amounts{Discount: 500, DiscountItem: "hat"}, []int64{0, 0, 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.amounts.LineDiscounts(items)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("got %v, want %v", got, tt.want)
+					break
+				}
+			}
+		})
+	}
+}
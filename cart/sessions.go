@@ -0,0 +1,98 @@
+package cart
+
+/* Server side record of the session ids handed out in session cookies */
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"server/error_messages"
+	"time"
+)
+
+type Session struct {
+	ID         string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	ExpiresAt  time.Time
+	// Revoked sessions are never resumed, ex: once their cart was paid for
+	Revoked bool
+}
+
+// How long the sessions of carts from before the sessions table are kept
+const adoptedSessionLifetime = 7 * 24 * time.Hour
+
+func (r *SQLiteDatabase) CreateSession(id string, expires_at time.Time) error {
+	now := time.Now().Unix()
+	_, err := r.db.Exec("INSERT INTO sessions(id, created_at, last_seen_at, expires_at) values(?,?,?,?)",
+		id, now, now, expires_at.Unix())
+	return err
+}
+
+func (r *SQLiteDatabase) GetSession(id string) (*Session, error) {
+	var session Session
+	var created_at, last_seen_at, expires_at, revoked_at int64
+	row := r.db.QueryRow("SELECT id, created_at, last_seen_at, expires_at, revoked_at FROM sessions WHERE id = ?", id)
+	if err := row.Scan(&session.ID, &created_at, &last_seen_at, &expires_at, &revoked_at); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, error_messages.ErrNotExists
+		}
+		return nil, err
+	}
+	session.CreatedAt = time.Unix(created_at, 0)
+	session.LastSeenAt = time.Unix(last_seen_at, 0)
+	session.ExpiresAt = time.Unix(expires_at, 0)
+	session.Revoked = revoked_at != 0
+	return &session, nil
+}
+
+// Record that the session was used and extend it until expires_at
+func (r *SQLiteDatabase) TouchSession(id string, expires_at time.Time) error {
+	res, err := r.db.Exec("UPDATE sessions SET last_seen_at = ?, expires_at = ? WHERE id = ?",
+		time.Now().Unix(), expires_at.Unix(), id)
+	return checkSessionUpdate(res, err)
+}
+
+func (r *SQLiteDatabase) RevokeSession(id string) error {
+	res, err := r.db.Exec("UPDATE sessions SET revoked_at = ? WHERE id = ? AND revoked_at = 0", time.Now().Unix(), id)
+	return checkSessionUpdate(res, err)
+}
+
+// Delete sessions that expired or were revoked, returning how many. Their
+// carts are kept.
+func (r *SQLiteDatabase) DeleteExpiredSessions(now time.Time) (int64, error) {
+	res, err := r.db.Exec("DELETE FROM sessions WHERE expires_at <= ? OR revoked_at != 0", now.Unix())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func checkSessionUpdate(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return error_messages.ErrNotExists
+	}
+	return nil
+}
+
+// Give the carts that were still being shopped with when the sessions table
+// was created a session, so their customers don't lose them.
+func (r *SQLiteDatabase) adoptCartSessions() error {
+	now := time.Now()
+	res, err := r.db.Exec("INSERT OR IGNORE INTO sessions(id, created_at, last_seen_at, expires_at) SELECT session_id, ?, ?, ? FROM shopping_cart WHERE state IN (?, ?)",
+		now.Unix(), now.Unix(), now.Add(adoptedSessionLifetime).Unix(), CartOpen, CartCheckingOut)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		log.Printf("Migrate: Created sessions for %d existing carts\n", n)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package cart
+
+/* Tracking numbers of the packages an order was shipped in */
+
+import (
+	"time"
+)
+
+type Shipment struct {
+	ID             int64
+	OrderID        int64
+	Carrier        string
+	TrackingNumber string
+	TrackingURL    string
+	// Zero until Printify reports it
+	ShippedAt   time.Time
+	DeliveredAt time.Time
+}
+
+// Store a shipment, or update the shipment with the same tracking number
+func (r *SQLiteDatabase) SaveShipment(shipment Shipment) error {
+	_, err := r.db.Exec(`INSERT INTO order_shipments(order_id, carrier, tracking_number, tracking_url, shipped_at) values(?,?,?,?,?)
+		ON CONFLICT(order_id, tracking_number) DO UPDATE SET carrier = excluded.carrier, tracking_url = excluded.tracking_url, shipped_at = excluded.shipped_at`,
+		shipment.OrderID, shipment.Carrier, shipment.TrackingNumber, shipment.TrackingURL, unixOrZero(shipment.ShippedAt))
+	return err
+}
+
+// Record the delivery of a shipment, storing the shipment if it is new
+func (r *SQLiteDatabase) DeliverShipment(shipment Shipment) error {
+	_, err := r.db.Exec(`INSERT INTO order_shipments(order_id, carrier, tracking_number, tracking_url, delivered_at) values(?,?,?,?,?)
+		ON CONFLICT(order_id, tracking_number) DO UPDATE SET delivered_at = excluded.delivered_at`,
+		shipment.OrderID, shipment.Carrier, shipment.TrackingNumber, shipment.TrackingURL, unixOrZero(shipment.DeliveredAt))
+	return err
+}
+
+func (r *SQLiteDatabase) GetOrderShipments(order_id int64) ([]Shipment, error) {
+	rows, err := r.db.Query("SELECT id, order_id, carrier, tracking_number, tracking_url, shipped_at, delivered_at FROM order_shipments WHERE order_id = ? ORDER BY id", order_id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var shipments []Shipment
+	for rows.Next() {
+		var shipment Shipment
+		var shipped_at, delivered_at int64
+		err := rows.Scan(&shipment.ID, &shipment.OrderID, &shipment.Carrier, &shipment.TrackingNumber, &shipment.TrackingURL, &shipped_at, &delivered_at)
+		if err != nil {
+			return nil, err
+		}
+		shipment.ShippedAt = timeOrZero(shipped_at)
+		shipment.DeliveredAt = timeOrZero(delivered_at)
+		shipments = append(shipments, shipment)
+	}
+	return shipments, rows.Err()
+}
+
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func timeOrZero(unix int64) time.Time {
+	if unix == 0 {
+		return time.Time{}
+	}
+	return time.Unix(unix, 0)
+}
@@ -0,0 +1,92 @@
+package cart
+
+/* Ledger of verified webhook events so retried deliveries are only handled once */
+
+import (
+	"database/sql"
+	"errors"
+	"server/error_messages"
+	"time"
+)
+
+type WebhookEventStatus string
+
+const (
+	WebhookProcessing WebhookEventStatus = "processing"
+	WebhookProcessed  WebhookEventStatus = "processed"
+	WebhookFailed     WebhookEventStatus = "failed"
+)
+
+// A delivery still marked processing after this long is assumed to have died
+// and may be picked up by a retry.
+const webhookProcessingTimeout = 5 * time.Minute
+
+// Record that an event is being processed. Returns ErrDuplicate if the event
+// was already processed, or ErrInProgress if another delivery of it is being
+// processed right now.
+func (r *SQLiteDatabase) BeginWebhookEvent(event_id string, event_type string) error {
+	now := time.Now()
+
+	_, err := r.db.Exec("INSERT INTO webhook_events(event_id, type, status, received_at, updated_at) values(?,?,?,?,?)",
+		event_id, event_type, WebhookProcessing, now.Unix(), now.Unix())
+	if err == nil {
+		return nil
+	}
+
+	var status WebhookEventStatus
+	var updated_at int64
+	row := r.db.QueryRow("SELECT status, updated_at FROM webhook_events WHERE event_id = ?", event_id)
+	if scan_err := row.Scan(&status, &updated_at); scan_err != nil {
+		if errors.Is(scan_err, sql.ErrNoRows) {
+			// The insert failed for some other reason
+			return err
+		}
+		return scan_err
+	}
+
+	switch {
+	case status == WebhookProcessed:
+		return error_messages.ErrDuplicate
+	case status == WebhookProcessing && now.Sub(time.Unix(updated_at, 0)) < webhookProcessingTimeout:
+		return error_messages.ErrInProgress
+	}
+
+	// Retry of a failed or abandoned delivery, claim it unless another
+	// delivery just did.
+	res, err := r.db.Exec("UPDATE webhook_events SET status = ?, attempts = attempts + 1, updated_at = ? WHERE event_id = ? AND status = ? AND updated_at = ?",
+		WebhookProcessing, now.Unix(), event_id, status, updated_at)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return error_messages.ErrInProgress
+	}
+	return nil
+}
+
+// Record the outcome of processing an event
+func (r *SQLiteDatabase) FinishWebhookEvent(event_id string, process_err error) error {
+	status, last_error := WebhookProcessed, ""
+	if process_err != nil {
+		status, last_error = WebhookFailed, process_err.Error()
+	}
+
+	res, err := r.db.Exec("UPDATE webhook_events SET status = ?, last_error = ?, updated_at = ? WHERE event_id = ?",
+		status, last_error, time.Now().Unix(), event_id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return error_messages.ErrUpdateFailed
+	}
+
+	return nil
+}
@@ -0,0 +1,263 @@
+package catalog
+
+/* Load and validate the store's product lineup from a catalog file */
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"server/error_messages"
+	"strings"
+)
+
+var Store *Catalog
+
+type Catalog struct {
+	Products []*Product `json:"products"`
+}
+
+type Product struct {
+	ID     string   `json:"id"`
+	Name   string   `json:"name"`
+	Price  int64    `json:"price"` // Base price in cents
+	Sizes  []string `json:"sizes"`
+	Colors []string `json:"colors"`
+	// Added to the base price for a size, ex: {"2xl": 200, "3xl": 400}
+	SizeSurcharges map[string]int64 `json:"size_surcharges,omitempty"`
+	// Replace the computed price of specific variants
+	VariantPrices []VariantPrice `json:"variant_prices,omitempty"`
+	// Templates used to build the image key and SKU for a variant, see
+	// expandTemplate for the supported placeholders.
+	Image string `json:"image"`
+	SKU   string `json:"sku"`
+}
+
+type VariantPrice struct {
+	Size  string `json:"size"`
+	Color string `json:"color"`
+	Price int64  `json:"price"`
+}
+
+// A single purchasable (item, size, color) combination.
+type Variant struct {
+	Product *Product
+	Size    string
+	Color   string
+}
+
+func InitCatalog(filename string) {
+	c, err := Load(filename)
+	if err != nil {
+		log.Printf("InitCatalog failed:\n")
+		log.Fatal(err)
+	}
+	Store = c
+}
+
+// Read a catalog from a JSON file and validate it.
+func Load(filename string) (*Catalog, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var c Catalog
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+
+	return &c, nil
+}
+
+// Validate makes sure every product is complete and that no two variants in
+// the catalog would be submitted to Printify with the same SKU.
+func (c *Catalog) Validate() error {
+	if len(c.Products) == 0 {
+		return fmt.Errorf("catalog has no products")
+	}
+
+	ids := map[string]bool{}
+	skus := map[string]string{}
+	for i, product := range c.Products {
+		switch {
+		case product.ID == "":
+			return fmt.Errorf("product %d: missing id", i)
+		case ids[product.ID]:
+			return fmt.Errorf("product %s: duplicate id", product.ID)
+		case product.Name == "":
+			return fmt.Errorf("product %s: missing name", product.ID)
+		case product.Price <= 0:
+			return fmt.Errorf("product %s: price must be greater than zero", product.ID)
+		case len(product.Sizes) == 0:
+			return fmt.Errorf("product %s: no sizes", product.ID)
+		case len(product.Colors) == 0:
+			return fmt.Errorf("product %s: no colors", product.ID)
+		case product.SKU == "":
+			return fmt.Errorf("product %s: missing sku template", product.ID)
+		}
+		ids[product.ID] = true
+
+		if dup := duplicate(product.Sizes); dup != "" {
+			return fmt.Errorf("product %s: duplicate size %q", product.ID, dup)
+		}
+		if dup := duplicate(product.Colors); dup != "" {
+			return fmt.Errorf("product %s: duplicate color %q", product.ID, dup)
+		}
+
+		for size, surcharge := range product.SizeSurcharges {
+			if !contains(product.Sizes, size) {
+				return fmt.Errorf("product %s: surcharge for unknown size %q", product.ID, size)
+			}
+			if surcharge < 0 {
+				return fmt.Errorf("product %s: negative surcharge for size %q", product.ID, size)
+			}
+		}
+		for _, override := range product.VariantPrices {
+			if !contains(product.Sizes, override.Size) || !contains(product.Colors, override.Color) {
+				return fmt.Errorf("product %s: price for unknown variant %s/%s", product.ID, override.Size, override.Color)
+			}
+			if override.Price <= 0 {
+				return fmt.Errorf("product %s: price for %s/%s must be greater than zero", product.ID, override.Size, override.Color)
+			}
+		}
+
+		for _, variant := range product.Variants() {
+			sku := variant.SKU()
+			if other, ok := skus[sku]; ok {
+				return fmt.Errorf("product %s: sku %s is also used by %s", product.ID, sku, other)
+			}
+			skus[sku] = product.ID
+		}
+	}
+
+	return nil
+}
+
+// Return the product with the given item id.
+func (c *Catalog) Product(id string) (*Product, bool) {
+	for _, product := range c.Products {
+		if product.ID == id {
+			return product, true
+		}
+	}
+	return nil, false
+}
+
+// Return the variant for an item, size and color, or ErrInvalidItem if the
+// catalog does not sell that combination.
+func (c *Catalog) Variant(item string, size string, color string) (*Variant, error) {
+	product, ok := c.Product(item)
+	if !ok || !contains(product.Sizes, size) || !contains(product.Colors, color) {
+		return nil, error_messages.ErrInvalidItem
+	}
+	return &Variant{Product: product, Size: size, Color: color}, nil
+}
+
+// The lowest price of any of the product's variants, used for "from" prices.
+func (p *Product) MinPrice() int64 {
+	min := int64(-1)
+	for _, variant := range p.Variants() {
+		if price := variant.Price(); min < 0 || price < min {
+			min = price
+		}
+	}
+	return min
+}
+
+// Every size and color combination of a product.
+func (p *Product) Variants() []*Variant {
+	variants := []*Variant{}
+	for _, size := range p.Sizes {
+		for _, color := range p.Colors {
+			variants = append(variants, &Variant{Product: p, Size: size, Color: color})
+		}
+	}
+	return variants
+}
+
+// The amount charged for the variant in cents: an explicit variant price if
+// the catalog has one, otherwise the base price plus any size surcharge.
+func (v *Variant) Price() int64 {
+	for _, override := range v.Product.VariantPrices {
+		if override.Size == v.Size && override.Color == v.Color {
+			return override.Price
+		}
+	}
+	return v.Product.Price + v.Product.SizeSurcharges[v.Size]
+}
+
+func (v *Variant) DisplayPrice() string {
+	return FormatPrice(v.Price())
+}
+
+func (v *Variant) SKU() string {
+	return v.expandTemplate(v.Product.SKU)
+}
+
+func (v *Variant) ImageKey() string {
+	if v.Product.Image == "" {
+		return v.Product.ID + "_" + v.Color
+	}
+	return v.expandTemplate(v.Product.Image)
+}
+
+/*
+Template placeholders:
+
+	{item}   product id          ex: tshirt
+	{size}   size as listed      ex: xl
+	{color}  color as listed     ex: black
+	{SIZE}   uppercase size      ex: XL
+	{COLOR}  uppercase color     ex: BLACK
+	{COLOR2} first two letters of the color, uppercase  ex: BL
+*/
+func (v *Variant) expandTemplate(template string) string {
+	color2 := v.Color
+	if len(color2) > 2 {
+		color2 = color2[:2]
+	}
+	replacer := strings.NewReplacer(
+		"{item}", v.Product.ID,
+		"{size}", v.Size,
+		"{color}", v.Color,
+		"{SIZE}", strings.ToUpper(v.Size),
+		"{COLOR}", strings.ToUpper(v.Color),
+		"{COLOR2}", strings.ToUpper(color2),
+	)
+	return replacer.Replace(template)
+}
+
+// Format an amount in cents for display, ex: 3000 -> "$30", 3250 -> "$32.50"
+func FormatPrice(cents int64) string {
+	if cents%100 == 0 {
+		return fmt.Sprintf("$%d", cents/100)
+	}
+	return fmt.Sprintf("$%.2f", float64(cents)/100)
+}
+
+// contains checks if a value is present in a slice
+func contains(s []string, str string) bool {
+	for _, v := range s {
+		if v == str {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the first value that appears twice in a slice
+func duplicate(s []string) string {
+	seen := map[string]bool{}
+	for _, v := range s {
+		if seen[v] {
+			return v
+		}
+		seen[v] = true
+	}
+	return ""
+}
@@ -0,0 +1,56 @@
+package catalog
+
+/* Printify product data synced for the catalog's SKUs */
+
+import (
+	"sync"
+)
+
+// The Printify side of a catalog variant, matched by SKU.
+type PrintifyVariant struct {
+	SKU         string
+	ProductID   string
+	VariantID   int
+	Price       int64 // Printify retail price in cents, informational only
+	IsEnabled   bool
+	IsAvailable bool
+	Image       string
+}
+
+var (
+	printifyMu       sync.RWMutex
+	printifyVariants map[string]PrintifyVariant
+)
+
+// Replace the synced Printify variants. A nil map means no sync has happened
+// yet, in which case every catalog variant is treated as available and orders
+// fall back to SKU matching.
+func SetPrintifyVariants(variants map[string]PrintifyVariant) {
+	printifyMu.Lock()
+	defer printifyMu.Unlock()
+	printifyVariants = variants
+}
+
+func synced() bool {
+	printifyMu.RLock()
+	defer printifyMu.RUnlock()
+	return printifyVariants != nil
+}
+
+// Return the Printify variant matching this variant's SKU.
+func (v *Variant) Printify() (PrintifyVariant, bool) {
+	printifyMu.RLock()
+	defer printifyMu.RUnlock()
+	pv, ok := printifyVariants[v.SKU()]
+	return pv, ok
+}
+
+// A variant can be bought if Printify has it enabled and available. Before
+// the first sync every variant is considered available.
+func (v *Variant) Available() bool {
+	if !synced() {
+		return true
+	}
+	pv, ok := v.Printify()
+	return ok && pv.IsEnabled && pv.IsAvailable
+}
@@ -1,22 +1,59 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
 
 var (
-	PRINTIFY_API_TOKEN    = ""
-	SHOP_ID               = 0
-	STRIPE_SECRET         = ""
-	STRIPE_WEBHOOK_SECRET = ""
-	CSRF_AUTH_TOKEN       = ""
-	LOGFILE               = ""
+	PRINTIFY_API_TOKEN      = ""
+	SHOP_ID                 = 0
+	STRIPE_SECRET           = ""
+	STRIPE_WEBHOOK_SECRET   = ""
+	PRINTIFY_WEBHOOK_SECRET = ""
+	CSRF_AUTH_TOKEN         = ""
+	ORDER_TOKEN_SECRET      = ""
+	ORDER_STATUS_URL        = ""
+	SMTP_ADDR               = ""
+	SMTP_USERNAME           = ""
+	SMTP_PASSWORD           = ""
+	EMAIL_FROM              = ""
+	ALERT_WEBHOOK_URL       = ""
+	ALERT_EMAIL             = ""
+	LOGFILE                 = ""
+	CATALOG_FILE            = "catalog.json"
+	TAX_RATES_FILE          = "tax_rates.json"
+	SHIPPING_RATES_FILE     = "shipping_rates.json"
+	SHIPPING_QUOTE_TTL      = time.Hour
+	PRINTIFY_SYNC_INTERVAL  = time.Hour
+	ALLOWED_COUNTRIES       = []string{}
+	BLOCKED_COUNTRIES       = []string{}
+	APP_ENV                 = "development"
+	COOKIE_SECURE           = true
+	COOKIE_HTTPONLY         = true
+	COOKIE_SAMESITE         = http.SameSiteStrictMode
+	COOKIE_DOMAIN           = ""
+	COOKIE_PATH             = "/"
+	COOKIE_MAX_AGE          = 7 * 24 * time.Hour
+	CSRF_MAX_AGE            = 12 * time.Hour
+	CSRF_TRUSTED_ORIGINS    = []string{}
 )
 
+// Values of SameSite that COOKIE_SAMESITE accepts
+var sameSiteModes = map[string]http.SameSite{
+	"strict": http.SameSiteStrictMode,
+	"lax":    http.SameSiteLaxMode,
+	"none":   http.SameSiteNoneMode,
+}
+
 func InitConf() {
 	err := godotenv.Load()
 	if err != nil {
@@ -34,7 +71,171 @@ func InitConf() {
 
 	STRIPE_WEBHOOK_SECRET = os.Getenv("STRIPE_WEBHOOK_SECRET")
 
+	PRINTIFY_WEBHOOK_SECRET = os.Getenv("PRINTIFY_WEBHOOK_SECRET")
+
 	CSRF_AUTH_TOKEN = os.Getenv("CSRF_AUTH_TOKEN")
 
+	ORDER_TOKEN_SECRET = os.Getenv("ORDER_TOKEN_SECRET")
+
+	ORDER_STATUS_URL = os.Getenv("ORDER_STATUS_URL")
+
+	SMTP_ADDR = os.Getenv("SMTP_ADDR")
+
+	SMTP_USERNAME = os.Getenv("SMTP_USERNAME")
+
+	SMTP_PASSWORD = os.Getenv("SMTP_PASSWORD")
+
+	EMAIL_FROM = os.Getenv("EMAIL_FROM")
+
+	ALERT_WEBHOOK_URL = os.Getenv("ALERT_WEBHOOK_URL")
+
+	ALERT_EMAIL = os.Getenv("ALERT_EMAIL")
+
 	LOGFILE = os.Getenv("LOGFILE")
+
+	if catalog_file := os.Getenv("CATALOG_FILE"); catalog_file != "" {
+		CATALOG_FILE = catalog_file
+	}
+
+	if tax_rates_file := os.Getenv("TAX_RATES_FILE"); tax_rates_file != "" {
+		TAX_RATES_FILE = tax_rates_file
+	}
+
+	if shipping_rates_file := os.Getenv("SHIPPING_RATES_FILE"); shipping_rates_file != "" {
+		SHIPPING_RATES_FILE = shipping_rates_file
+	}
+
+	if ttl := os.Getenv("SHIPPING_QUOTE_TTL"); ttl != "" {
+		SHIPPING_QUOTE_TTL, err = time.ParseDuration(ttl)
+		if err != nil {
+			log.Fatal("SHIPPING_QUOTE_TTL could not be parsed as a duration")
+		}
+	}
+
+	ALLOWED_COUNTRIES = countryList(os.Getenv("ALLOWED_COUNTRIES"))
+
+	BLOCKED_COUNTRIES = countryList(os.Getenv("BLOCKED_COUNTRIES"))
+
+	if interval := os.Getenv("PRINTIFY_SYNC_INTERVAL"); interval != "" {
+		PRINTIFY_SYNC_INTERVAL, err = time.ParseDuration(interval)
+		if err != nil {
+			log.Fatal("PRINTIFY_SYNC_INTERVAL could not be parsed as a duration")
+		}
+	}
+
+	initCookies()
+
+	if app_env := os.Getenv("APP_ENV"); app_env != "" {
+		APP_ENV = app_env
+	}
+	if APP_ENV == "production" {
+		if err := checkProduction(); err != nil {
+			log.Fatalf("Refusing to start in production: %v", err)
+		}
+	}
+}
+
+// Settings shared by the session and CSRF cookies
+func initCookies() {
+	var err error
+
+	if secure := os.Getenv("COOKIE_SECURE"); secure != "" {
+		COOKIE_SECURE, err = strconv.ParseBool(secure)
+		if err != nil {
+			log.Fatal("COOKIE_SECURE could not be parsed as a bool")
+		}
+	}
+
+	if http_only := os.Getenv("COOKIE_HTTPONLY"); http_only != "" {
+		COOKIE_HTTPONLY, err = strconv.ParseBool(http_only)
+		if err != nil {
+			log.Fatal("COOKIE_HTTPONLY could not be parsed as a bool")
+		}
+	}
+
+	if same_site := os.Getenv("COOKIE_SAMESITE"); same_site != "" {
+		mode, ok := sameSiteModes[strings.ToLower(same_site)]
+		if !ok {
+			log.Fatal("COOKIE_SAMESITE must be strict, lax or none")
+		}
+		COOKIE_SAMESITE = mode
+	}
+
+	COOKIE_DOMAIN = os.Getenv("COOKIE_DOMAIN")
+
+	if path := os.Getenv("COOKIE_PATH"); path != "" {
+		if !strings.HasPrefix(path, "/") {
+			log.Fatal("COOKIE_PATH must start with /")
+		}
+		COOKIE_PATH = path
+	}
+
+	if max_age := os.Getenv("COOKIE_MAX_AGE"); max_age != "" {
+		COOKIE_MAX_AGE, err = time.ParseDuration(max_age)
+		if err != nil || COOKIE_MAX_AGE <= 0 {
+			log.Fatal("COOKIE_MAX_AGE could not be parsed as a positive duration")
+		}
+	}
+
+	if max_age := os.Getenv("CSRF_MAX_AGE"); max_age != "" {
+		CSRF_MAX_AGE, err = time.ParseDuration(max_age)
+		if err != nil || CSRF_MAX_AGE <= 0 {
+			log.Fatal("CSRF_MAX_AGE could not be parsed as a positive duration")
+		}
+	}
+
+	// Browsers drop SameSite=None cookies that aren't Secure, which would
+	// silently break sessions and CSRF in any profile
+	if COOKIE_SAMESITE == http.SameSiteNoneMode && !COOKIE_SECURE {
+		log.Fatal("COOKIE_SAMESITE=none requires COOKIE_SECURE=true")
+	}
+
+	CSRF_TRUSTED_ORIGINS = splitList(os.Getenv("CSRF_TRUSTED_ORIGINS"))
+	for _, origin := range CSRF_TRUSTED_ORIGINS {
+		// gorilla/csrf compares them to the host of the Referer
+		if strings.Contains(origin, "/") {
+			log.Fatalf("CSRF_TRUSTED_ORIGINS takes host names, ex: shop.example.com, not %s", origin)
+		}
+	}
+}
+
+// Values that are fine while developing but not on a live store
+func checkProduction() error {
+	switch {
+	case !COOKIE_SECURE:
+		return errors.New("COOKIE_SECURE must be true")
+	case !COOKIE_HTTPONLY:
+		return errors.New("COOKIE_HTTPONLY must be true")
+	case COOKIE_SAMESITE == http.SameSiteNoneMode:
+		return errors.New("COOKIE_SAMESITE must be strict or lax")
+	case len(CSRF_AUTH_TOKEN) < 32:
+		// gorilla/csrf expects a 32 byte key
+		return errors.New("CSRF_AUTH_TOKEN must be at least 32 characters")
+	}
+	for _, origin := range CSRF_TRUSTED_ORIGINS {
+		if origin == "*" || strings.HasPrefix(origin, "localhost") || strings.HasPrefix(origin, "127.0.0.1") {
+			return fmt.Errorf("CSRF_TRUSTED_ORIGINS can't include %s", origin)
+		}
+	}
+	return nil
+}
+
+// Split a comma separated list, ex: "shop.example.com, www.example.com"
+func splitList(list string) []string {
+	values := []string{}
+	for _, value := range strings.Split(list, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// Split a comma separated list of country codes, ex: "US, CA"
+func countryList(list string) []string {
+	countries := splitList(list)
+	for i := range countries {
+		countries[i] = strings.ToUpper(countries[i])
+	}
+	return countries
 }
@@ -4,10 +4,29 @@ import "errors"
 
 var (
 	ErrDuplicate    = errors.New("record already exists")
+	ErrInProgress   = errors.New("already being processed")
 	ErrNotExists    = errors.New("row not exists")
 	ErrUpdateFailed = errors.New("update failed")
 	ErrDeleteFailed = errors.New("delete failed")
 
-	ErrInvalidItem = errors.New("invalid item")
-	ErrInvalidName = errors.New("invalid customer name")
+	ErrInvalidTransition = errors.New("invalid order status transition")
+
+	ErrInvalidItem     = errors.New("invalid item")
+	ErrUnavailableItem = errors.New("item is not available")
+	ErrInvalidName     = errors.New("invalid customer name")
+
+	ErrAddressMissing    = errors.New("this field is required")
+	ErrAddressTooLong    = errors.New("this field is too long")
+	ErrInvalidCountry    = errors.New("country is not a valid country code")
+	ErrCountryNotShipped = errors.New("we don't ship to this country")
+	ErrInvalidState      = errors.New("state is not valid for the country")
+	ErrInvalidPostalCode = errors.New("postal code is not valid for the country")
+	ErrInvalidPhone      = errors.New("phone number is not valid")
+
+	ErrPromoInvalid       = errors.New("promo code is not valid")
+	ErrPromoInactive      = errors.New("promo code is not active")
+	ErrPromoUsedUp        = errors.New("promo code has been used up")
+	ErrPromoMinimum       = errors.New("cart is below the promo code's minimum")
+	ErrPromoNotApplicable = errors.New("promo code doesn't apply to the items in the cart")
+	ErrPromoAlreadyUsed   = errors.New("promo code was already used with this email")
 )
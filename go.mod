@@ -1,16 +1,13 @@
 module server
 
-go 1.19
+go 1.21
 
 require (
 	github.com/ericdbishop/go-printify v1.0.2
-	github.com/gorilla/csrf v1.7.1
+	github.com/gorilla/csrf v1.7.3
 	github.com/joho/godotenv v1.5.1
 	github.com/mattn/go-sqlite3 v1.14.16
 	github.com/stripe/stripe-go/v74 v74.10.0
 )
 
-require (
-	github.com/gorilla/securecookie v1.1.1 // indirect
-	github.com/pkg/errors v0.9.1 // indirect
-)
+require github.com/gorilla/securecookie v1.1.2 // indirect
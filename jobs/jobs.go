@@ -0,0 +1,234 @@
+package jobs
+
+/* Durable background jobs stored in SQLite and retried with backoff */
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"server/cart"
+	"server/error_messages"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	MaxAttempts = 8
+	// Delay before the first retry, doubled after every failed attempt
+	baseBackoff = 30 * time.Second
+	maxBackoff  = 2 * time.Hour
+)
+
+// A Handler runs one job. Returning an error schedules another attempt.
+type Handler func(payload []byte) error
+
+var (
+	handlersMu sync.RWMutex
+	handlers   = map[string]Handler{}
+	wake       = make(chan struct{}, 1)
+	// Called when a job runs out of attempts
+	onDead = func(job *cart.Job, err error) {}
+)
+
+// Register the handler for a kind of job
+func Register(kind string, handler Handler) {
+	handlersMu.Lock()
+	defer handlersMu.Unlock()
+	handlers[kind] = handler
+}
+
+// Set the function called when a job runs out of attempts
+func OnDead(f func(job *cart.Job, err error)) {
+	onDead = f
+}
+
+// Store a job to be run by the worker. The payload is encoded as JSON.
+func Enqueue(kind string, payload interface{}) (*cart.Job, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	job, err := cart.Repo.CreateJob(kind, string(data), MaxAttempts)
+	if err != nil {
+		log.Printf("jobs.Enqueue: Could not store %s job: %v\n", kind, err)
+		return nil, err
+	}
+
+	log.Printf("Job %d: Enqueued %s %s\n", job.ID, kind, data)
+
+	// Let an idle worker pick it up without waiting for the next poll
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+
+	return job, nil
+}
+
+// Enqueue a job unless the same kind and payload is already queued, running
+// or done. Returns the existing job in that case.
+func EnqueueOnce(kind string, payload interface{}) (*cart.Job, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	job, err := cart.Repo.GetLiveJob(kind, string(data))
+	if err == nil {
+		log.Printf("Job %d: %s %s is already %s\n", job.ID, kind, data, job.Status)
+		return job, nil
+	} else if err != error_messages.ErrNotExists {
+		return nil, err
+	}
+
+	return Enqueue(kind, payload)
+}
+
+// Start the worker, checking for due jobs every poll interval
+func Start(poll time.Duration) {
+	if n, err := cart.Repo.ResetRunningJobs(); err != nil {
+		log.Printf("jobs.Start: Could not reset running jobs: %v\n", err)
+	} else if n > 0 {
+		log.Printf("jobs.Start: %d interrupted jobs returned to the queue\n", n)
+	}
+
+	go func() {
+		ticker := time.NewTicker(poll)
+		defer ticker.Stop()
+		for {
+			RunDue()
+			select {
+			case <-ticker.C:
+			case <-wake:
+			}
+		}
+	}()
+}
+
+// Run every job that is currently due
+func RunDue() {
+	for {
+		job, err := cart.Repo.ClaimJob()
+		if err == error_messages.ErrNotExists {
+			return
+		}
+		if err != nil {
+			log.Printf("jobs.RunDue: Could not claim job: %v\n", err)
+			return
+		}
+		run(job)
+	}
+}
+
+func run(job *cart.Job) {
+	handlersMu.RLock()
+	handler, ok := handlers[job.Kind]
+	handlersMu.RUnlock()
+
+	var err error
+	if !ok {
+		err = fmt.Errorf("no handler for job kind %s", job.Kind)
+	} else {
+		err = safeCall(handler, []byte(job.Payload))
+	}
+
+	if err == nil {
+		log.Printf("Job %d: %s done after %d attempts\n", job.ID, job.Kind, job.Attempts)
+		if err := cart.Repo.CompleteJob(job.ID); err != nil {
+			log.Printf("Job %d: Could not mark done: %v\n", job.ID, err)
+		}
+		return
+	}
+
+	run_at := time.Now().Add(Backoff(job.Attempts))
+	if job.Attempts >= job.MaxAttempts {
+		log.Printf("Job %d: %s DEAD after %d attempts: %v\n", job.ID, job.Kind, job.Attempts, err)
+	} else {
+		log.Printf("Job %d: %s attempt %d/%d failed, retrying at %s: %v\n", job.ID, job.Kind, job.Attempts, job.MaxAttempts, run_at.Format(time.RFC3339), err)
+	}
+
+	if err := cart.Repo.FailJob(job, err.Error(), run_at); err != nil {
+		log.Printf("Job %d: Could not record failure: %v\n", job.ID, err)
+	}
+
+	if job.Attempts >= job.MaxAttempts {
+		onDead(job, err)
+	}
+}
+
+// Don't let a panicking handler take the worker down with it
+func safeCall(handler Handler, payload []byte) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return handler(payload)
+}
+
+// How long to wait after the given number of failed attempts
+func Backoff(attempts int) time.Duration {
+	backoff := baseBackoff
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= maxBackoff {
+			return maxBackoff
+		}
+	}
+	return backoff
+}
+
+// Write the jobs that aren't done to w, for the -list-jobs flag
+func List(w io.Writer) error {
+	queued, err := cart.Repo.GetJobsByStatus(cart.JobPending, cart.JobRunning, cart.JobDead)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tKIND\tSTATUS\tATTEMPTS\tRUN AT\tPAYLOAD\tLAST ERROR")
+	for _, job := range queued {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%d/%d\t%s\t%s\t%s\n", job.ID, job.Kind, job.Status, job.Attempts, job.MaxAttempts,
+			job.RunAt.Format(time.RFC3339), job.Payload, job.LastError)
+	}
+	return tw.Flush()
+}
+
+// Give a job, usually a dead one, a fresh set of attempts. Running jobs can't
+// be requeued.
+func Requeue(id int64) error {
+	if err := cart.Repo.RequeueJob(id); err != nil {
+		return err
+	}
+	log.Printf("Job %d: Requeued\n", id)
+	return nil
+}
+
+// Run the job of a kind and payload again as soon as possible: its latest job
+// is requeued unless it is running, and a job is enqueued if there is none.
+// Returns the job that will run.
+func RequeueOnce(kind string, payload interface{}) (*cart.Job, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	job, err := cart.Repo.GetLatestJob(kind, string(data))
+	if err == error_messages.ErrNotExists {
+		return Enqueue(kind, payload)
+	} else if err != nil {
+		return nil, err
+	}
+
+	if job.Status == cart.JobRunning {
+		log.Printf("Job %d: %s %s is already running\n", job.ID, kind, data)
+		return job, nil
+	}
+	if err := Requeue(job.ID); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
@@ -1,18 +1,40 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"server/api/external"
 	"server/api/site"
 	"server/cart"
+	"server/catalog"
 	"server/config"
+	"server/jobs"
+	"server/notify"
+	"server/session"
+	"server/shipping"
+	"server/tax"
+	"text/tabwriter"
+	"time"
 
 	"github.com/gorilla/csrf"
 )
 
 func main() {
+	retry_orders := flag.Bool("retry-orders", false, "requeue the submission jobs of orders whose Printify submission failed, then exit")
+	list_jobs := flag.Bool("list-jobs", false, "print queued, running and dead jobs, then exit")
+	requeue_job := flag.Int64("requeue-job", 0, "give the job with this id a fresh set of attempts, then exit")
+	approve_order := flag.Int64("approve-order", 0, "release the needs_review order with this id for fulfillment, then exit")
+	add_promo := flag.String("add-promo", "", "create the promo code described by this JSON, then exit")
+	list_promos := flag.Bool("list-promos", false, "print every promo code and its uses, then exit")
+	test_email := flag.String("test-email", "", "send a sample order confirmation to this address, then exit")
+	order_events := flag.Int64("order-events", 0, "print the audit trail of the order with this id, then exit")
+	flag.Parse()
+
 	config.InitConf()
 
 	// open log file
@@ -26,21 +48,174 @@ func main() {
 
 	CSRF := csrf.Protect(
 		[]byte(config.CSRF_AUTH_TOKEN),
-		csrf.SameSite(csrf.SameSiteStrictMode),
-		//csrf.Secure(false), // REMOVE IN PRODUCTION
+		csrf.Secure(config.COOKIE_SECURE),
+		csrf.HttpOnly(config.COOKIE_HTTPONLY),
+		csrf.SameSite(csrf.SameSiteMode(config.COOKIE_SAMESITE)),
+		csrf.Domain(config.COOKIE_DOMAIN),
+		csrf.Path(config.COOKIE_PATH),
+		csrf.MaxAge(int(config.CSRF_MAX_AGE.Seconds())),
+		csrf.TrustedOrigins(config.CSRF_TRUSTED_ORIGINS),
 	)
 
 	mux := http.NewServeMux()
 	webhook_mux := http.NewServeMux()
 
+	catalog.InitCatalog(config.CATALOG_FILE)
+	tax.InitTax(config.TAX_RATES_FILE)
+	shipping.InitShipping(config.SHIPPING_RATES_FILE, config.SHIPPING_QUOTE_TTL)
 	cart.InitDatabase()
 	site.InitHandlers(mux)
 	external.InitHandlers(mux)
 	external.InitWebhook(webhook_mux)
 	external.InitPrintifyClient(config.PRINTIFY_API_TOKEN, config.SHOP_ID)
+	notify.InitNotify(emailSender(), orderStatusURL)
+	notify.InitAlerts(config.ALERT_WEBHOOK_URL, config.ALERT_EMAIL)
+	jobs.OnDead(func(job *cart.Job, err error) {
+		// Alerts that can't be delivered would only queue more of them
+		if job.Kind == notify.SendAlertJob {
+			return
+		}
+		notify.AlertOwner("job_dead", fmt.Sprint(job.ID),
+			fmt.Sprintf("Job %d (%s %s) gave up after %d attempts: %v. Requeue it with -requeue-job=%d", job.ID, job.Kind, job.Payload, job.Attempts, err, job.ID))
+	})
+
+	switch {
+	case *list_jobs:
+		if err := jobs.List(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case *approve_order != 0:
+		if err := external.ApproveOrder(*approve_order); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not approve order %d: %v\n", *approve_order, err)
+			os.Exit(1)
+		}
+		return
+	case *add_promo != "":
+		if err := addPromoCode(*add_promo); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not add promo code: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	case *list_promos:
+		if err := listPromoCodes(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case *test_email != "":
+		if err := notify.SendTest(*test_email); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not send test email to %s: %v\n", *test_email, err)
+			os.Exit(1)
+		}
+		return
+	case *order_events != 0:
+		if err := external.ListOrderEvents(os.Stdout, *order_events); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not list events of order %d: %v\n", *order_events, err)
+			os.Exit(1)
+		}
+		return
+	case *requeue_job != 0:
+		if err := jobs.Requeue(*requeue_job); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not requeue job %d: %v\n", *requeue_job, err)
+			os.Exit(1)
+		}
+		return
+	case *retry_orders:
+		queued, err := external.RetryFailedSubmissions()
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Requeued the submission of %d failed orders\n", queued)
+		return
+	}
+
+	external.InitCatalogSync(config.PRINTIFY_SYNC_INTERVAL)
+
+	jobs.Start(15 * time.Second)
+	session.StartSweeper()
 
 	log.Printf("Beginning to listen on ports 4242 and 4343\n")
 	go http.ListenAndServe("localhost:4343", webhook_mux)
-	err = http.ListenAndServe("localhost:4242", CSRF(mux))
+	err = http.ListenAndServe("localhost:4242", plaintextHTTP(CSRF(mux)))
 	log.Fatal(err)
 }
+
+// While developing over plain HTTP there is no https Referer for gorilla/csrf
+// to check, so requests are marked as plaintext. Production requires secure
+// cookies and always gets the Referer and Origin checks.
+func plaintextHTTP(h http.Handler) http.Handler {
+	if config.APP_ENV == "production" || config.COOKIE_SECURE {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, csrf.PlaintextHTTPRequest(r))
+	})
+}
+
+// Send emails over SMTP when a server is configured, otherwise log them
+func emailSender() notify.Sender {
+	if config.SMTP_ADDR == "" {
+		log.Printf("SMTP_ADDR is not set, emails will only be logged\n")
+		return notify.LogSender{}
+	}
+	return &notify.SMTPSender{
+		Addr:     config.SMTP_ADDR,
+		Username: config.SMTP_USERNAME,
+		Password: config.SMTP_PASSWORD,
+		From:     config.EMAIL_FROM,
+	}
+}
+
+// Link to the order status page with a signed token for the label
+func orderStatusURL(label string) string {
+	token := site.OrderStatusToken(label)
+	if config.ORDER_STATUS_URL == "" || label == "" || token == "" {
+		return ""
+	}
+	return config.ORDER_STATUS_URL + "?token=" + token
+}
+
+// Create a promo code from its JSON description, ex:
+// {"code": "SPRING10", "kind": "percent", "amount": 10, "ends_at": "2024-06-01T00:00:00Z"}
+func addPromoCode(data string) error {
+	var promo cart.PromoCode
+	if err := json.Unmarshal([]byte(data), &promo); err != nil {
+		return err
+	}
+	promo.Code = cart.NormalizePromoCode(promo.Code)
+	if err := promo.Validate(); err != nil {
+		return err
+	}
+	if promo.Item != "" {
+		if _, ok := catalog.Store.Product(promo.Item); !ok {
+			return fmt.Errorf("%s is not in the catalog", promo.Item)
+		}
+	}
+	return cart.Repo.CreatePromoCode(promo)
+}
+
+func listPromoCodes(w io.Writer) error {
+	promos, err := cart.Repo.AllPromoCodes()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "CODE\tKIND\tAMOUNT\tITEM\tMIN\tSTARTS\tENDS\tUSES\tONCE PER EMAIL")
+	for _, promo := range promos {
+		starts, ends := "-", "-"
+		if !promo.StartsAt.IsZero() {
+			starts = promo.StartsAt.Format(time.RFC3339)
+		}
+		if !promo.EndsAt.IsZero() {
+			ends = promo.EndsAt.Format(time.RFC3339)
+		}
+		uses := fmt.Sprint(promo.Uses)
+		if promo.MaxUses > 0 {
+			uses += fmt.Sprintf("/%d", promo.MaxUses)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%d\t%s\t%s\t%s\t%t\n", promo.Code, promo.Kind, promo.Amount, promo.Item,
+			promo.MinSubtotal, starts, ends, uses, promo.OncePerEmail)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,141 @@
+package notify
+
+/* Alerts to the store owner, posted to a webhook and emailed by the job
+ * worker so they are retried and survive the process that raised them.
+ * Repeats of the same alert are held back so one outage doesn't send hundreds
+ * of them. */
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"server/cart"
+	"server/jobs"
+	"time"
+)
+
+const (
+	// How long to hold back repeats of an alert after it was sent
+	alertInterval = time.Hour
+
+	SendAlertJob = "send_alert"
+)
+
+type OwnerAlert struct {
+	Kind    string `json:"kind"`
+	Key     string `json:"key"`
+	Message string `json:"message"`
+	// Times the alert was raised since it was last sent, including this one
+	Count int       `json:"count"`
+	Time  time.Time `json:"time"`
+}
+
+// Alerts get a job per channel, so a failing webhook doesn't resend the email
+type alertPayload struct {
+	Channel string     `json:"channel"`
+	Alert   OwnerAlert `json:"alert"`
+}
+
+const (
+	alertWebhook = "webhook"
+	alertEmail   = "email"
+)
+
+var (
+	alert_webhook_url string
+	alert_email       string
+	alert_http        = &http.Client{Timeout: 10 * time.Second}
+)
+
+// Set where owner alerts go. Either may be empty, alerts are always logged.
+func InitAlerts(webhook_url string, email string) {
+	alert_webhook_url = webhook_url
+	alert_email = email
+
+	jobs.Register(SendAlertJob, handleSendAlertJob)
+}
+
+// Alert the owner that something needs their attention. kind is what went
+// wrong and key what it went wrong for, such as an order id; an alert with the
+// same kind and key is sent at most once per alertInterval.
+func AlertOwner(kind string, key string, message string) {
+	log.Printf("ALERT %s %s: %s\n", kind, key, message)
+
+	now := time.Now()
+	send, count, err := cart.Repo.RecordAlert(kind+":"+key, now, alertInterval)
+	if err != nil {
+		// Better a repeated alert than a lost one
+		log.Printf("AlertOwner: Could not record %s alert: %v\n", kind, err)
+		send, count = true, 1
+	}
+	if !send {
+		return
+	}
+
+	alert := OwnerAlert{Kind: kind, Key: key, Message: message, Count: count, Time: now}
+	if alert_webhook_url != "" {
+		enqueueAlert(alertWebhook, alert)
+	}
+	if alert_email != "" {
+		enqueueAlert(alertEmail, alert)
+	}
+}
+
+func enqueueAlert(channel string, alert OwnerAlert) {
+	if _, err := jobs.Enqueue(SendAlertJob, alertPayload{Channel: channel, Alert: alert}); err != nil {
+		log.Printf("AlertOwner: Could not queue %s alert to %s: %v\n", alert.Kind, channel, err)
+	}
+}
+
+func handleSendAlertJob(payload []byte) error {
+	var p alertPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+
+	switch p.Channel {
+	case alertWebhook:
+		if alert_webhook_url == "" {
+			return nil
+		}
+		return postAlert(p.Alert)
+	case alertEmail:
+		if alert_email == "" {
+			return nil
+		}
+		return sender.Send(alertMessage(p.Alert))
+	}
+	return fmt.Errorf("unknown alert channel %s", p.Channel)
+}
+
+func alertMessage(alert OwnerAlert) Message {
+	body := alert.Message + "\n"
+	if alert.Count > 1 {
+		body += fmt.Sprintf("\nThis happened %d times since the last alert.\n", alert.Count)
+	}
+	return Message{
+		To:      alert_email,
+		Subject: fmt.Sprintf("[alert] %s %s", alert.Kind, alert.Key),
+		Body:    body,
+	}
+}
+
+func postAlert(alert OwnerAlert) error {
+	data, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	resp, err := alert_http.Post(alert_webhook_url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("alert webhook responded %d", resp.StatusCode)
+	}
+	return nil
+}
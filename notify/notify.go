@@ -0,0 +1,239 @@
+package notify
+
+/* Transactional emails to customers, rendered from templates and sent by the
+ * job worker so failed sends are retried */
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"server/cart"
+	"server/catalog"
+	"server/jobs"
+	"strings"
+	"text/template"
+)
+
+const (
+	OrderConfirmation = "order_confirmation"
+	Shipment          = "shipment"
+	Refund            = "refund"
+
+	sendEmailJob = "send_email"
+)
+
+//go:embed templates/*.txt
+var templateFiles embed.FS
+
+var (
+	sender    Sender = LogSender{}
+	templates        = map[string]*template.Template{}
+	// Builds the order status link for a label, empty if there is none
+	statusURL = func(label string) string { return "" }
+)
+
+// Set the sender emails go out through and load the templates. status_url
+// builds the link customers can check their order at.
+func InitNotify(s Sender, status_url func(label string) string) {
+	sender = s
+	statusURL = status_url
+
+	for _, name := range []string{OrderConfirmation, Shipment, Refund} {
+		t, err := template.ParseFS(templateFiles, "templates/"+name+".txt")
+		if err != nil {
+			log.Fatal(err)
+		}
+		templates[name] = t
+	}
+
+	jobs.Register(sendEmailJob, handleSendEmailJob)
+}
+
+type emailPayload struct {
+	Template string `json:"template"`
+	OrderID  int64  `json:"order_id"`
+	// Tells apart emails of the same kind for one order, such as the tracking
+	// number of a shipment or the amount refunded
+	Key string `json:"key,omitempty"`
+}
+
+// Queue an email about an order. The same email is only ever queued once.
+func Enqueue(name string, order_id int64, key string) error {
+	_, err := jobs.EnqueueOnce(sendEmailJob, emailPayload{Template: name, OrderID: order_id, Key: key})
+	if err != nil {
+		log.Printf("notify.Enqueue: Could not queue %s email for order %d: %v\n", name, order_id, err)
+	}
+	return err
+}
+
+func handleSendEmailJob(payload []byte) error {
+	var p emailPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+
+	order, err := cart.Repo.GetOrderByID(p.OrderID)
+	if err != nil {
+		return err
+	}
+
+	if order.Customer.Email == "" {
+		log.Printf("handleSendEmailJob: Order %d has no email, not sending %s\n", order.ID, p.Template)
+		return nil
+	}
+
+	msg, err := Render(p.Template, order, p.Key)
+	if err != nil {
+		return err
+	}
+
+	if err := sender.Send(*msg); err != nil {
+		return err
+	}
+
+	log.Printf("Sent %s email for order %d\n", p.Template, order.ID)
+	cart.Repo.AddOrderEvent(order.ID, "email", p.Template)
+	return nil
+}
+
+type emailData struct {
+	Name      string
+	Label     string
+	Items     []emailItem
+	Subtotal  string
+	Shipping  string
+	Discount  string
+	Tax       string
+	Total     string
+	Refunded  string
+	Address   string
+	Shipment  *cart.Shipment
+	StatusURL string
+}
+
+type emailItem struct {
+	Name     string
+	Size     string
+	Color    string
+	Quantity int64
+	Price    string
+}
+
+// Render an email about the order
+func Render(name string, order *cart.Order, key string) (*Message, error) {
+	t, ok := templates[name]
+	if !ok {
+		return nil, fmt.Errorf("no email template %s", name)
+	}
+
+	data, err := formEmailData(name, order, key)
+	if err != nil {
+		return nil, err
+	}
+
+	var subject, body bytes.Buffer
+	if err := t.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return nil, err
+	}
+	if err := t.Execute(&body, data); err != nil {
+		return nil, err
+	}
+
+	return &Message{
+		To:      order.Customer.Email,
+		Subject: strings.TrimSpace(subject.String()),
+		Body:    body.String(),
+	}, nil
+}
+
+func formEmailData(name string, order *cart.Order, key string) (*emailData, error) {
+	first_name := "there"
+	if fields := strings.Fields(order.Customer.Name); len(fields) > 0 {
+		first_name = fields[0]
+	}
+
+	data := &emailData{
+		Name:      first_name,
+		Label:     order.Label,
+		Subtotal:  catalog.FormatPrice(order.Subtotal),
+		Shipping:  catalog.FormatPrice(order.Shipping),
+		Total:     catalog.FormatPrice(order.Total),
+		Refunded:  catalog.FormatPrice(order.Refunded),
+		Address:   formatAddress(order.Customer),
+		StatusURL: statusURL(order.Label),
+	}
+
+	if order.Tax > 0 {
+		data.Tax = catalog.FormatPrice(order.Tax)
+	}
+
+	if order.Discount > 0 {
+		data.Discount = "-" + catalog.FormatPrice(order.Discount)
+		if order.PromoCode != "" {
+			data.Discount += " (" + order.PromoCode + ")"
+		}
+	}
+
+	for _, item := range order.Items {
+		item_name := item.Item
+		if product, ok := catalog.Store.Product(item.Item); ok {
+			item_name = product.Name
+		}
+		data.Items = append(data.Items, emailItem{
+			Name:     item_name,
+			Size:     item.Size,
+			Color:    item.Color,
+			Quantity: item.Quantity,
+			Price:    catalog.FormatPrice(item.UnitPrice * item.Quantity),
+		})
+	}
+
+	if name == Shipment {
+		shipments, err := cart.Repo.GetOrderShipments(order.ID)
+		if err != nil {
+			return nil, err
+		}
+		for i := range shipments {
+			if shipments[i].TrackingNumber == key {
+				data.Shipment = &shipments[i]
+			}
+		}
+	}
+
+	return data, nil
+}
+
+func formatAddress(customer cart.Customer) string {
+	parts := []string{}
+	for _, part := range []string{customer.Name, customer.Line1, customer.Line2,
+		strings.TrimSpace(customer.City + ", " + customer.State + " " + customer.PostalCode), customer.Country} {
+		part = strings.Trim(strings.TrimSpace(part), ",")
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, "\n  ")
+}
+
+// Send an order confirmation for a made up order to check the SMTP settings
+func SendTest(to string) error {
+	order := &cart.Order{
+		Label:    "00000",
+		Subtotal: 3000,
+		Shipping: 850,
+		Total:    3850,
+		Customer: cart.Customer{Name: "Test Customer", Email: to, Line1: "1 Main St", City: "Springfield", State: "IL", PostalCode: "62701", Country: "US"},
+	}
+	if len(catalog.Store.Products) > 0 {
+		product := catalog.Store.Products[0]
+		order.Items = []cart.OrderItem{{Item: product.ID, Size: product.Sizes[0], Color: product.Colors[0], Quantity: 1, UnitPrice: 3000}}
+	}
+
+	msg, err := Render(OrderConfirmation, order, "")
+	if err != nil {
+		return err
+	}
+	return sender.Send(*msg)
+}
@@ -7,6 +7,7 @@ import (
 	"log"
 	"net/http"
 	"server/cart"
+	"server/config"
 	"server/error_messages"
 	"time"
 )
@@ -15,9 +16,12 @@ import (
 func RetrieveCart(w http.ResponseWriter, r *http.Request) (*cart.ShoppingCart, error) {
 	var shopping_cart *cart.ShoppingCart
 
-	session_id := BeginSession(w, r)
+	session_id, err := BeginSession(w, r)
+	if err != nil {
+		return nil, err
+	}
 	// Retrieve database entry
-	shopping_cart, err := cart.Repo.GetCartBySessionID(session_id)
+	shopping_cart, err = cart.Repo.GetCartBySessionID(session_id)
 	if err == error_messages.ErrNotExists {
 		// Create new session and cart record
 		shopping_cart, err = cart.Repo.CreateCartEntry(session_id)
@@ -25,25 +29,101 @@ func RetrieveCart(w http.ResponseWriter, r *http.Request) (*cart.ShoppingCart, e
 			log.Printf("Error: RetrieveCart: Could not create new cart entry for %s, error: %v\n", session_id, err)
 			return nil, err
 		}
+	} else if err != nil {
+		return nil, err
 	}
 
 	return shopping_cart, nil
 }
 
-// BeginSession creates a new user session ID and stores it in the user's
-// cookie if the user doesn't have one yet.
-func BeginSession(w http.ResponseWriter, r *http.Request) string {
+const (
+	// A session also expires this long after it was created, however often it's used
+	sessionMaxAge = 30 * 24 * time.Hour
+	// Sessions are extended at most this often, so not every request writes
+	sessionTouchInterval = 10 * time.Minute
+	// How often expired and revoked sessions are deleted
+	sweepInterval = time.Hour
+)
+
+// BeginSession returns the user's session ID. Cookies whose session is
+// unknown, expired or revoked get a new session and cookie instead. A session
+// expires after COOKIE_MAX_AGE without being used. No cookie is set if the
+// session couldn't be stored.
+func BeginSession(w http.ResponseWriter, r *http.Request) (string, error) {
 	cookie, err := r.Cookie("session")
 	// Along with checking if cookie exists, make sure the length is valid
-	if err != nil || len(cookie.Value) != 44 {
-		// Create cookie and attach it to the server response
-		session_id := SessionId()
-		setSessionCookie(w, session_id)
-		log.Printf("New session cookie created: %s\n", session_id)
-		return session_id
-	} else {
-		return cookie.Value
+	if err == nil && len(cookie.Value) == 44 {
+		ok, err := resumeSession(w, cookie.Value)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return cookie.Value, nil
+		}
+	}
+
+	// Create cookie and attach it to the server response
+	session_id := SessionId()
+	expires := time.Now().Add(config.COOKIE_MAX_AGE)
+	if err := cart.Repo.CreateSession(session_id, expires); err != nil {
+		log.Printf("Error in BeginSession: Could not store session: %v\n", err)
+		return "", err
+	}
+	setSessionCookie(w, session_id, expires)
+	log.Printf("New session cookie created: %s\n", session_id)
+	return session_id, nil
+}
+
+// Returns false if the session can't be used, and an error if it couldn't be
+// looked up, so a database error doesn't cost the customer their cart
+func resumeSession(w http.ResponseWriter, session_id string) (bool, error) {
+	stored, err := cart.Repo.GetSession(session_id)
+	if err == error_messages.ErrNotExists {
+		log.Printf("resumeSession: Unknown session %s\n", session_id)
+		return false, nil
+	} else if err != nil {
+		log.Printf("Error in resumeSession: Could not retrieve session: %v\n", err)
+		return false, err
+	}
+
+	now := time.Now()
+	if stored.Revoked || !now.Before(stored.ExpiresAt) {
+		log.Printf("resumeSession: Session %s expired or was revoked\n", session_id)
+		return false, nil
+	}
+
+	if now.Sub(stored.LastSeenAt) >= sessionTouchInterval {
+		expires := now.Add(config.COOKIE_MAX_AGE)
+		if max_expires := stored.CreatedAt.Add(sessionMaxAge); expires.After(max_expires) {
+			expires = max_expires
+		}
+		if err := cart.Repo.TouchSession(session_id, expires); err != nil {
+			log.Printf("Error in resumeSession: Could not extend session: %v\n", err)
+			return true, nil
+		}
+		setSessionCookie(w, session_id, expires)
 	}
+	return true, nil
+}
+
+// Stop a session from being used again. Its next request gets a new session
+// and with it an empty cart.
+func Revoke(session_id string) error {
+	return cart.Repo.RevokeSession(session_id)
+}
+
+// Delete expired and revoked sessions now and every sweepInterval
+func StartSweeper() {
+	go func() {
+		for {
+			if n, err := cart.Repo.DeleteExpiredSessions(time.Now()); err != nil {
+				log.Printf("Error in session sweeper: %v\n", err)
+			} else if n > 0 {
+				log.Printf("Session sweeper: Deleted %d expired sessions\n", n)
+			}
+			time.Sleep(sweepInterval)
+		}
+	}()
 }
 
 func RetrieveItems(session_id string) ([]cart.CartItem, error) {
@@ -60,7 +140,8 @@ func RetrieveItems(session_id string) ([]cart.CartItem, error) {
 	return retrieved_items, err
 }
 
-// Called when a PaymentIntent is created in stripe.go
+// Called when a PaymentIntent is created in stripe.go. The cart's promo code
+// is taken off the amount.
 func RetrieveOrderAmount(w http.ResponseWriter, session_id string) (int64, error) {
 	var amount int64 = 0
 	retrieved_items, err := RetrieveItems(session_id)
@@ -71,11 +152,20 @@ func RetrieveOrderAmount(w http.ResponseWriter, session_id string) (int64, error
 		return amount, err
 	}
 
-	for _, item := range retrieved_items {
-		amount += cart.ItemtoPrice[item.Item]
+	amounts, err := cart.CartAmounts(retrieved_items, 0, RetrievePromoCode(session_id), "")
+	if err != nil && !cart.IsPromoError(err) {
+		return amount, err
 	}
+	return amounts.Total, nil
+}
 
-	return amount, err
+// Returns empty string if no promo code is applied to the cart
+func RetrievePromoCode(session_id string) string {
+	shopping_cart, err := cart.Repo.GetCartBySessionID(session_id)
+	if err != nil {
+		return ""
+	}
+	return shopping_cart.PromoCode
 }
 
 func RetrievePaymentIntentItems(payment_intent_id string) ([]cart.CartItem, error) {
@@ -105,11 +195,22 @@ func RetrieveOrderAmountAndItems(payment_intent_id string) (int64, error) {
 		return amount, err
 	}
 
-	for _, item := range retrieved_items {
-		amount += cart.ItemtoPrice[item.Item]
-	}
+	return ItemsAmount(retrieved_items)
+}
 
-	return amount, err
+// Sum the price of each item. Items that are no longer sold make the whole
+// cart invalid rather than being charged at zero.
+func ItemsAmount(items []cart.CartItem) (int64, error) {
+	var amount int64 = 0
+	for _, item := range items {
+		price, err := item.Price()
+		if err != nil {
+			log.Printf("ItemsAmount: %s %s %s is not in the catalog\n", item.Item, item.Size, item.Color)
+			return 0, err
+		}
+		amount += price * item.Quantity
+	}
+	return amount, nil
 }
 
 // Called after a PaymentIntent is created in stripe.go to store a user's payment intent
@@ -133,13 +234,17 @@ func RetrievePaymentIntentID(session_id string) (string, error) {
 }
 
 // Create and set the user's cookie in the http response
-func setSessionCookie(w http.ResponseWriter, session_id string) {
-	expiration := time.Now().Add(7 * 24 * time.Hour)
+func setSessionCookie(w http.ResponseWriter, session_id string, expiration time.Time) {
 	cookie := http.Cookie{
 		Name:     "session",
 		Value:    session_id,
+		Path:     config.COOKIE_PATH,
+		Domain:   config.COOKIE_DOMAIN,
 		Expires:  expiration,
-		SameSite: 3, // "strict"
+		MaxAge:   int(time.Until(expiration).Round(time.Second).Seconds()),
+		Secure:   config.COOKIE_SECURE,
+		HttpOnly: config.COOKIE_HTTPONLY,
+		SameSite: config.COOKIE_SAMESITE,
 	}
 	http.SetCookie(w, &cookie)
 }
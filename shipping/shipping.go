@@ -0,0 +1,225 @@
+package shipping
+
+/* Fallback shipping rates by zone and item count, and a cache of shipping quotes */
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every zone must have a rate for standard shipping
+const Standard = "standard"
+
+// Where the shipping costs of a quote came from
+type Source string
+
+const (
+	Live     Source = "live"     // Quoted by Printify just now
+	Cached   Source = "cached"   // Quoted by Printify for the same items and destination earlier
+	Fallback Source = "fallback" // Printify couldn't quote, priced from the rate table
+)
+
+// Used for destinations no zone covers, and for every destination if there
+// is no rate table
+var DefaultZone = &Zone{
+	Name:      "default",
+	Countries: []string{"*"},
+	Methods:   map[string]Rate{Standard: {FirstItem: 850}},
+}
+
+var (
+	Rates  = &Table{}
+	Quotes = NewCache(0)
+)
+
+type Table struct {
+	Zones []*Zone `json:"zones"`
+}
+
+// The rates of a group of countries. "*" in Countries matches every country
+// that isn't in another zone.
+type Zone struct {
+	Name      string   `json:"name"`
+	Countries []string `json:"countries"`
+	// By shipping method, ex: standard, priority or express
+	Methods map[string]Rate `json:"methods"`
+}
+
+// What a shipment of any number of items costs, in cents
+type Rate struct {
+	FirstItem      int64 `json:"first_item"`
+	AdditionalItem int64 `json:"additional_item"`
+}
+
+// Load the rate table and start caching quotes for ttl. Without a table the
+// DefaultZone's flat rate is charged whenever Printify can't quote.
+func InitShipping(filename string, ttl time.Duration) {
+	Quotes = NewCache(ttl)
+
+	t, err := Load(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("InitShipping: %s does not exist, the flat rate will be charged when Printify can't quote shipping\n", filename)
+		return
+	}
+	if err != nil {
+		log.Printf("InitShipping failed:\n")
+		log.Fatal(err)
+	}
+	Rates = t
+}
+
+// Read a rate table from a JSON file and validate it.
+func Load(filename string) (*Table, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var t Table
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+
+	if err := t.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+
+	return &t, nil
+}
+
+func (t *Table) Validate() error {
+	seen := map[string]string{}
+	for i, zone := range t.Zones {
+		if zone.Name == "" {
+			zone.Name = fmt.Sprintf("zone %d", i)
+		}
+		if len(zone.Countries) == 0 {
+			return fmt.Errorf("%s: no countries", zone.Name)
+		}
+		for j, country := range zone.Countries {
+			country = strings.ToUpper(strings.TrimSpace(country))
+			if other, ok := seen[country]; ok {
+				return fmt.Errorf("%s: %s is already in %s", zone.Name, country, other)
+			}
+			seen[country] = zone.Name
+			zone.Countries[j] = country
+		}
+
+		if _, ok := zone.Methods[Standard]; !ok {
+			return fmt.Errorf("%s: missing a %s rate", zone.Name, Standard)
+		}
+		for method, rate := range zone.Methods {
+			if rate.FirstItem <= 0 || rate.AdditionalItem < 0 {
+				return fmt.Errorf("%s: %s rate must have a positive first_item and additional_item", zone.Name, method)
+			}
+		}
+	}
+	return nil
+}
+
+// The zone a country ships in
+func (t *Table) Lookup(country string) *Zone {
+	country = strings.ToUpper(strings.TrimSpace(country))
+
+	var rest *Zone
+	for _, zone := range t.Zones {
+		for _, c := range zone.Countries {
+			if c == country {
+				return zone
+			}
+			if c == "*" {
+				rest = zone
+			}
+		}
+	}
+	if rest != nil {
+		return rest
+	}
+	return DefaultZone
+}
+
+// The cost of shipping a number of items to a country by each method
+func (t *Table) Costs(country string, items int64) map[string]int64 {
+	zone := t.Lookup(country)
+	costs := map[string]int64{}
+	for method, rate := range zone.Methods {
+		costs[method] = rate.Cost(items)
+	}
+	return costs
+}
+
+func (r Rate) Cost(items int64) int64 {
+	if items < 1 {
+		items = 1
+	}
+	return r.FirstItem + r.AdditionalItem*(items-1)
+}
+
+// Expired quotes are dropped once the cache holds this many, and all of them
+// if none have expired
+const maxCachedQuotes = 1024
+
+// Shipping costs by method, kept for a while so repeated address updates
+// don't each ask Printify for a quote. A zero ttl disables the cache.
+type Cache struct {
+	mu     sync.Mutex
+	ttl    time.Duration
+	quotes map[string]cachedQuote
+}
+
+type cachedQuote struct {
+	costs   map[string]int64
+	expires time.Time
+}
+
+func NewCache(ttl time.Duration) *Cache {
+	return &Cache{ttl: ttl, quotes: map[string]cachedQuote{}}
+}
+
+// Identifies what a quote was for. Items are described by variant and quantity
+// in any order; only the country and region of the address affect the cost.
+func QuoteKey(items []string, country string, region string) string {
+	sorted := append([]string{}, items...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",") + "|" + strings.ToUpper(strings.TrimSpace(country)) + "|" + strings.ToUpper(strings.TrimSpace(region))
+}
+
+func (c *Cache) Get(key string) (map[string]int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	quote, ok := c.quotes[key]
+	if !ok || time.Now().After(quote.expires) {
+		return nil, false
+	}
+	return quote.costs, true
+}
+
+func (c *Cache) Put(key string, costs map[string]int64) {
+	if c.ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if len(c.quotes) >= maxCachedQuotes {
+		for k, quote := range c.quotes {
+			if now.After(quote.expires) {
+				delete(c.quotes, k)
+			}
+		}
+		if len(c.quotes) >= maxCachedQuotes {
+			c.quotes = map[string]cachedQuote{}
+		}
+	}
+	c.quotes[key] = cachedQuote{costs: costs, expires: now.Add(c.ttl)}
+}
@@ -0,0 +1,85 @@
+package shipping
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCosts(t *testing.T) {
+	table := &Table{Zones: []*Zone{
+		{
+			Name:      "United States",
+			Countries: []string{"US"},
+			Methods: map[string]Rate{
+				"standard": {FirstItem: 475, AdditionalItem: 240},
+				"priority": {FirstItem: 1000, AdditionalItem: 300},
+				"express":  {FirstItem: 1500, AdditionalItem: 400},
+			},
+		},
+		{
+			Name:      "North America",
+			Countries: []string{" ca", "MX "},
+			Methods:   map[string]Rate{"standard": {FirstItem: 939, AdditionalItem: 439}},
+		},
+		{
+			Name:      "Everywhere else",
+			Countries: []string{"*"},
+			Methods:   map[string]Rate{"standard": {FirstItem: 1000, AdditionalItem: 400}},
+		},
+	}}
+	if err := table.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	no_rest := &Table{Zones: table.Zones[:1]}
+
+	tests := []struct {
+		name    string
+		table   *Table
+		country string
+		items   int64
+		want    map[string]int64
+	}{
+		{"one item", table, "US", 1, map[string]int64{"standard": 475, "priority": 1000, "express": 1500}},
+		{"additional items", table, "US", 3, map[string]int64{"standard": 955, "priority": 1600, "express": 2300}},
+		{"no items costs one", table, "US", 0, map[string]int64{"standard": 475, "priority": 1000, "express": 1500}},
+		{"country is normalized", table, " us ", 1, map[string]int64{"standard": 475, "priority": 1000, "express": 1500}},
+		{"countries in the table are normalized", table, "CA", 2, map[string]int64{"standard": 1378}},
+		{"rest of the world", table, "DE", 2, map[string]int64{"standard": 1400}},
+		{"default zone without a match", no_rest, "DE", 2, map[string]int64{"standard": 850}},
+		{"default zone without a table", &Table{}, "US", 1, map[string]int64{"standard": 850}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.table.Costs(tt.country, tt.items); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Costs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	standard := map[string]Rate{Standard: {FirstItem: 500}}
+
+	tests := []struct {
+		name  string
+		zones []*Zone
+		ok    bool
+	}{
+		{"valid", []*Zone{{Countries: []string{"US"}, Methods: standard}}, true},
+		{"no countries", []*Zone{{Methods: standard}}, false},
+		{"country in two zones", []*Zone{{Countries: []string{"US"}, Methods: standard}, {Countries: []string{"us"}, Methods: standard}}, false},
+		{"no standard rate", []*Zone{{Countries: []string{"US"}, Methods: map[string]Rate{"express": {FirstItem: 500}}}}, false},
+		{"free first item", []*Zone{{Countries: []string{"US"}, Methods: map[string]Rate{Standard: {}}}}, false},
+		{"negative additional item", []*Zone{{Countries: []string{"US"}, Methods: map[string]Rate{Standard: {FirstItem: 500, AdditionalItem: -1}}}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table := &Table{Zones: tt.zones}
+			if err := table.Validate(); (err == nil) != tt.ok {
+				t.Errorf("Validate() = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package tax
+
+/* Sales tax from a local table of rates by country, state and postal code */
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strings"
+)
+
+var Rates = &Table{}
+
+type Table struct {
+	Rates []*Rate `json:"rates"`
+}
+
+// The rate charged in a country, a state of it, or the postal codes of a state
+// starting with PostalPrefix. The most specific matching rate applies.
+type Rate struct {
+	Country      string  `json:"country"`
+	State        string  `json:"state,omitempty"`
+	PostalPrefix string  `json:"postal_prefix,omitempty"`
+	Percent      float64 `json:"percent"` // ex: 7.25
+	// Whether shipping charges are taxed along with the items
+	ShippingTaxable bool `json:"shipping_taxable"`
+	// Catalog item ids that aren't taxed here, ex: clothing exemptions
+	ExemptItems []string `json:"exempt_items,omitempty"`
+
+	// Percent in millionths of the amount, so tax is computed in integers
+	micros int64
+}
+
+// One priced line of a sale
+type Line struct {
+	Item   string
+	Amount int64
+	// The part of a discount taken off this line
+	Discount int64
+}
+
+type Sale struct {
+	Country    string
+	State      string
+	PostalCode string
+	Lines      []Line
+	// Shipping charged after any discount on it
+	Shipping int64
+}
+
+// Load the rate table. Without a table no tax is charged, which is logged so
+// it doesn't go unnoticed.
+func InitTax(filename string) {
+	t, err := Load(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("InitTax: %s does not exist, no sales tax will be charged\n", filename)
+		return
+	}
+	if err != nil {
+		log.Printf("InitTax failed:\n")
+		log.Fatal(err)
+	}
+	Rates = t
+}
+
+// Read a rate table from a JSON file and validate it.
+func Load(filename string) (*Table, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var t Table
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+
+	if err := t.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+
+	return &t, nil
+}
+
+func (t *Table) Validate() error {
+	seen := map[string]bool{}
+	for i, rate := range t.Rates {
+		rate.Country = strings.ToUpper(strings.TrimSpace(rate.Country))
+		rate.State = strings.ToUpper(strings.TrimSpace(rate.State))
+		rate.PostalPrefix = strings.TrimSpace(rate.PostalPrefix)
+
+		switch {
+		case rate.Country == "":
+			return fmt.Errorf("rate %d: missing country", i)
+		case rate.PostalPrefix != "" && rate.State == "":
+			return fmt.Errorf("rate %d: postal_prefix needs a state", i)
+		case rate.Percent < 0 || rate.Percent > 100:
+			return fmt.Errorf("rate %d: percent must be between 0 and 100", i)
+		}
+
+		key := rate.Country + "/" + rate.State + "/" + rate.PostalPrefix
+		if seen[key] {
+			return fmt.Errorf("rate %d: duplicate rate for %s", i, key)
+		}
+		seen[key] = true
+
+		rate.micros = int64(math.Round(rate.Percent * 10000))
+	}
+	return nil
+}
+
+// The rate for an address, nil if no tax is charged there
+func (t *Table) Lookup(country string, state string, postal_code string) *Rate {
+	country = strings.ToUpper(strings.TrimSpace(country))
+	state = strings.ToUpper(strings.TrimSpace(state))
+	postal_code = strings.TrimSpace(postal_code)
+
+	var best *Rate
+	best_score := -1
+	for _, rate := range t.Rates {
+		if rate.Country != country {
+			continue
+		}
+		score := 0
+		if rate.State != "" {
+			if rate.State != state {
+				continue
+			}
+			score = 1
+		}
+		if rate.PostalPrefix != "" {
+			if !strings.HasPrefix(postal_code, rate.PostalPrefix) {
+				continue
+			}
+			score = 2 + len(rate.PostalPrefix)
+		}
+		if score > best_score {
+			best, best_score = rate, score
+		}
+	}
+	return best
+}
+
+// The tax on a sale, rounded to the nearest cent
+func (t *Table) Calculate(sale Sale) int64 {
+	rate := t.Lookup(sale.Country, sale.State, sale.PostalCode)
+	if rate == nil || rate.micros == 0 {
+		return 0
+	}
+
+	var taxable int64 = 0
+	for _, line := range sale.Lines {
+		if !rate.exempt(line.Item) {
+			taxable += line.Amount - line.Discount
+		}
+	}
+	if rate.ShippingTaxable {
+		taxable += sale.Shipping
+	}
+	if taxable <= 0 {
+		return 0
+	}
+
+	return (taxable*rate.micros + 500000) / 1000000
+}
+
+func (r *Rate) exempt(item string) bool {
+	for _, exempt := range r.ExemptItems {
+		if exempt == item {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+package tax
+
+import "testing"
+
+func TestCalculate(t *testing.T) {
+	table := &Table{Rates: []*Rate{
+		{Country: "US", State: "CA", Percent: 7.25},
+		{Country: "US", State: "CA", PostalPrefix: "900", Percent: 9.5},
+		{Country: "US", State: "NY", Percent: 4, ShippingTaxable: true, ExemptItems: []string{"shirt"}},
+		{Country: "us", State: " tx ", Percent: 6.25, ShippingTaxable: true},
+		{Country: "CA", Percent: 5},
+		{Country: "US", State: "OR", Percent: 0},
+	}}
+	if err := table.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := []Line{
+		{Item: "shirt", Amount: 4000},
+		{Item: "mug", Amount: 1200},
+	}
+
+	tests := []struct {
+		name string
+		sale Sale
+		want int64
+	}{
+		{"state rate", Sale{Country: "US", State: "CA", PostalCode: "94105", Lines: lines, Shipping: 500}, 377},
+		{"postal prefix wins over state", Sale{Country: "US", State: "CA", PostalCode: "90012", Lines: lines}, 494},
+		{"address is normalized", Sale{Country: " us", State: "ca ", PostalCode: " 90012", Lines: lines}, 494},
+		{"exempt items and taxable shipping", Sale{Country: "US", State: "NY", Lines: lines, Shipping: 500}, 68},
+		{"line discounts are taken off", Sale{Country: "US", State: "CA", Lines: []Line{{Item: "shirt", Amount: 4000, Discount: 1000}, {Item: "mug", Amount: 1200, Discount: 300}}}, 283},
+		{"discount on exempt line doesn't lower tax", Sale{Country: "US", State: "NY", Lines: []Line{{Item: "shirt", Amount: 4000, Discount: 4000}, {Item: "mug", Amount: 1200}}}, 48},
+		{"rates in the table are normalized", Sale{Country: "US", State: "TX", Lines: lines, Shipping: 800}, 375},
+		{"country rate", Sale{Country: "CA", State: "ON", Lines: lines, Shipping: 500}, 260},
+		{"rounds to the nearest cent", Sale{Country: "US", State: "CA", Lines: []Line{{Item: "mug", Amount: 1000}}}, 73},
+		{"zero rate", Sale{Country: "US", State: "OR", Lines: lines}, 0},
+		{"no rate", Sale{Country: "US", State: "WA", Lines: lines}, 0},
+		{"no rate for the country", Sale{Country: "GB", Lines: lines}, 0},
+		{"fully discounted", Sale{Country: "US", State: "CA", Lines: []Line{{Item: "mug", Amount: 1200, Discount: 1200}}}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := table.Calculate(tt.sale); got != tt.want {
+				t.Errorf("Calculate() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		rates []*Rate
+		ok    bool
+	}{
+		{"valid", []*Rate{{Country: "US", State: "CA", PostalPrefix: "900", Percent: 9.5}}, true},
+		{"missing country", []*Rate{{State: "CA", Percent: 7.25}}, false},
+		{"postal prefix without state", []*Rate{{Country: "US", PostalPrefix: "900", Percent: 9.5}}, false},
+		{"negative percent", []*Rate{{Country: "US", Percent: -1}}, false},
+		{"percent over 100", []*Rate{{Country: "US", Percent: 101}}, false},
+		{"duplicate", []*Rate{{Country: "US", State: "CA", Percent: 7.25}, {Country: "us", State: "ca", Percent: 8}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table := &Table{Rates: tt.rates}
+			if err := table.Validate(); (err == nil) != tt.ok {
+				t.Errorf("Validate() = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}